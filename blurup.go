@@ -0,0 +1,118 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/die-net/fotomat/imager"
+	"net/http"
+	"strings"
+)
+
+const blurUpPrefix = "/blurup"
+
+func init() {
+	mux.HandleFunc(blurUpPrefix+"/", rateLimited(requestLimited(blurUpHandler)))
+}
+
+// blurUp is what /blurup/ answers for an image URL: everything needed to
+// lay out the image and show a blurred placeholder until it has loaded.
+type blurUp struct {
+	URL         string   `json:"url"`               // Of the full image.
+	Width       uint     `json:"width"`             // Of the full image.
+	Height      uint     `json:"height"`            // Of the full image.
+	Color       string   `json:"color"`             // Dominant, like "#a0b1c2".
+	Palette     []string `json:"palette,omitempty"` // Most common colors, most common first.
+	Placeholder string   `json:"placeholder"`       // A tiny blurred JPEG, as a data: URL.
+}
+
+func blurUpHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		sendError(w, nil, http.StatusMethodNotAllowed)
+		return
+	}
+
+	full := strings.TrimPrefix(r.URL.Path, blurUpPrefix)
+	path, params, err := parsePath(full)
+	if err != nil {
+		sendBadRequest(w, err)
+		return
+	}
+
+	url := sourceURL(r, path)
+	orig, err, status := fetchUrl(url)
+	if err != nil || status != http.StatusOK {
+		sendError(w, err, status)
+		return
+	}
+
+	b, err := processBlurUp(orig, params, w.(http.CloseNotifier).CloseNotify())
+	orig = nil // Free up image memory ASAP.
+	if err != nil {
+		sendError(w, err, 0)
+		return
+	}
+	b.URL = absoluteURL(r, full)
+
+	body, err := json.Marshal(b)
+	if err != nil {
+		sendError(w, err, 0)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// processBlurUp applies params to orig, then describes the result and
+// shrinks it to a placeholder, rather than saving it at full size.
+func processBlurUp(orig []byte, params imageParams, aborted <-chan bool) (*blurUp, error) {
+	img, err := openImage(orig, params)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+
+	result, err := decodeImage(img, params.operations, aborted)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+	defer func() { encodePool <- true }()
+
+	b := &blurUp{Width: result.Width, Height: result.Height}
+	if b.Color, err = result.DominantColor(); err != nil {
+		return nil, err
+	}
+	if *blurUpPalette > 0 {
+		if b.Palette, err = result.Palette(*blurUpPalette); err != nil {
+			return nil, err
+		}
+	}
+
+	// Placeholders are tiny previews, blurred after shrinking so the blur
+	// doesn't vanish in the resize.
+	img.Sharpen = false
+	img.BlurFactor = 1.0
+	img.BlurAfterResize = true
+	img.Preview = true
+	img.PreviewQuality = *previewQuality
+
+	if result.Width > *blurUpSize || result.Height > *blurUpSize {
+		op := imager.Operation{Type: imager.OpScale, Width: *blurUpSize, Height: *blurUpSize}
+		if err := result.Apply(op); err != nil {
+			return nil, err
+		}
+	}
+
+	thumb, err := result.GetAs("JPEG")
+	if err != nil {
+		return nil, err
+	}
+	b.Placeholder = "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(thumb)
+
+	return b, nil
+}
@@ -0,0 +1,42 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/die-net/fotomat/imager"
+	"net/http"
+)
+
+func init() {
+	// Like profiles, this reveals internals, so is only on -debug_listen.
+	http.HandleFunc("/debug/formats", formatsHandler)
+}
+
+// capabilities is what /debug/formats reports about the linked ImageMagick.
+type capabilities struct {
+	Version string   `json:"version"`
+	Encode  []string `json:"encode"`
+	Decode  []string `json:"decode"`
+}
+
+func formatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		sendError(w, nil, http.StatusMethodNotAllowed)
+		return
+	}
+
+	c := capabilities{Version: imager.Version()}
+	c.Encode, c.Decode = imager.Formats()
+
+	body, err := json.Marshal(c)
+	if err != nil {
+		sendError(w, err, 0)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
@@ -0,0 +1,30 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFormatsHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	formatsHandler(w, &http.Request{Method: "GET"})
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, w.Header().Get("Content-Type"), "application/json")
+
+	var c capabilities
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &c))
+	assert.Contains(t, c.Version, "ImageMagick")
+	assert.Contains(t, c.Encode, "JPEG")
+	assert.Contains(t, c.Decode, "JPEG")
+
+	w = httptest.NewRecorder()
+	formatsHandler(w, &http.Request{Method: "POST"})
+	assert.Equal(t, w.Code, http.StatusMethodNotAllowed)
+}
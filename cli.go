@@ -0,0 +1,40 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+var (
+	cliOperations = flag.String("operations", "", "Instead of serving HTTP, process an image from stdin to stdout with these operations, like \"=c400x400=s200x200\".")
+)
+
+func processStdin(operations string) error {
+	// Share the path suffix grammar, so shell scripts can use the same
+	// operations as URLs.
+	_, params, err := parsePath("/stdin" + operations)
+	if err != nil {
+		return fmt.Errorf("Invalid operations %q: %v", operations, err)
+	}
+
+	orig, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	poolInit(1)
+	thumb, err := processImage("stdin", orig, params, http.Header{}, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(thumb)
+	return err
+}
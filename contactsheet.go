@@ -0,0 +1,83 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/die-net/fotomat/imager"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var contactSheetColumns = flag.Uint("contact_sheet_columns", 4, "Columns of the frames /contactsheet/ lays out, unless the request asks with ?columns= (0 = one row).")
+
+const contactSheetPrefix = "/contactsheet"
+
+func init() {
+	mux.HandleFunc(contactSheetPrefix+"/", rateLimited(requestLimited(contactSheetHandler)))
+}
+
+// contactSheetHandler answers a URL like "/contactsheet/image.gif=s120x120"
+// with every frame of the animation laid out in a grid of cells that size,
+// as one still, for reviewing animations at a glance.
+func contactSheetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		sendError(w, nil, http.StatusMethodNotAllowed)
+		return
+	}
+
+	path, params, err := parsePath(strings.TrimPrefix(r.URL.Path, contactSheetPrefix))
+	if err == nil && (len(params.operations) != 1 || params.operations[0].Type != imager.OpScale) {
+		err = fmt.Errorf("Contact sheets need one scale operation, like \"=s120x120\"")
+	}
+	columns := *contactSheetColumns
+	if c := r.URL.Query().Get("columns"); err == nil && c != "" {
+		n, e := strconv.Atoi(c)
+		if e != nil || n < 0 || n > *maxOutputDimension {
+			err = fmt.Errorf("Columns %q isn't from 0 to %d", c, *maxOutputDimension)
+		}
+		columns = uint(n)
+	}
+	if err != nil {
+		sendBadRequest(w, err)
+		return
+	}
+
+	url := sourceURL(r, path)
+	orig, err, status := fetchUrl(url)
+	if err != nil || status != http.StatusOK {
+		sendError(w, err, status)
+		return
+	}
+
+	sheet, err := processContactSheet(orig, params, columns, w.(http.CloseNotifier).CloseNotify())
+	orig = nil // Free up image memory ASAP.
+	if err != nil {
+		sendError(w, err, 0)
+		return
+	}
+
+	w.Write(sheet)
+}
+
+// processContactSheet lays out the frames of orig in columns, each scaled
+// to fit params' one operation.
+func processContactSheet(orig []byte, params imageParams, columns uint, aborted <-chan bool) ([]byte, error) {
+	img, err := openImage(orig, params)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+
+	if !acquire(decodePool, aborted) {
+		return nil, clientGone
+	}
+	defer func() { decodePool <- true }()
+
+	op := params.operations[0]
+	return img.ContactSheet(columns, op.Width, op.Height)
+}
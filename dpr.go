@@ -0,0 +1,56 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"github.com/die-net/fotomat/imager"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+var (
+	dprHeader = flag.String("dpr_header", "", "Request header with the client's device pixel ratio, like \"Sec-CH-DPR\", to multiply requested sizes by; pages must ask for it with Accept-CH (\"\" = ignore).")
+	maxDPR    = flag.Uint("max_dpr", 2, "Largest device pixel ratio -dpr_header may multiply sizes by, at least 1.")
+)
+
+// scaleForDPR multiplies the sizes of ops by the device pixel ratio r's
+// client sends in -dpr_header, so one URL serves both standard and high
+// density displays.  Ratios are rounded to a whole number up to -max_dpr,
+// so caches hold only a few variants, and lowered where needed to stay
+// within -max_output_dimension.  The response is marked as varying by the
+// header.  Browsers only send client hints that the page embedding the
+// image asked for, so pages must send their own Accept-CH.
+func scaleForDPR(w http.ResponseWriter, r *http.Request, ops []imager.Operation) []imager.Operation {
+	if *dprHeader == "" {
+		return ops
+	}
+
+	w.Header().Add("Vary", *dprHeader)
+
+	// A missing or malformed ratio is taken as 1.
+	ratio, err := strconv.ParseFloat(r.Header.Get(*dprHeader), 64)
+	if err != nil || ratio < 1.5 {
+		return ops
+	}
+	dpr := uint(math.Min(math.Floor(ratio+0.5), float64(*maxDPR)))
+
+	scaled := make([]imager.Operation, len(ops))
+	for i, op := range ops {
+		// Rotations have no size, and aspects and percentages are only ratios.
+		if op.Type != imager.OpRotate && op.Type != imager.OpAspect && op.Type != imager.OpCropPercent {
+			m := dpr
+			for m > 1 && (op.Width*m > uint(*maxOutputDimension) || op.Height*m > uint(*maxOutputDimension)) {
+				m--
+			}
+			op.Width *= m
+			op.Height *= m
+		}
+		scaled[i] = op
+	}
+
+	return scaled
+}
@@ -5,30 +5,113 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/die-net/fotomat/imager"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/url"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
 var (
 	maxOutputDimension    = flag.Int("max_output_dimension", 2048, "Maximum width or height of an image response.")
+	maxOperations         = flag.Int("max_operations", 4, "Maximum number of operations chained in one request, bounding its CPU cost (0 = unlimited).")
 	maxBufferPixels       = flag.Uint("max_buffer_pixels", 6500000, "Maximum number of pixels to allocate for an intermediate image buffer.")
+	maxImageMemory        = flag.Uint64("max_image_memory", 0, "Maximum bytes of decoded pixels one image may take, across all its frames, checked once decoded (0 = unlimited).")
+	downscaleOversize     = flag.Bool("downscale_oversize", false, "Treat JPEGs larger than -max_buffer_pixels as if downscaled by a half, quarter or eighth to fit, rather than refusing them.")
 	maxProcessingDuration = flag.Duration("max_processing_duration", time.Minute, "Maximum duration we can be processing an image before assuming we crashed (0 = disable).")
 	localImageDirectory   = flag.String("local_image_directory", "", "Enable local image serving from this path (\"\" = proxy instead).")
-	pool                  chan bool
+	jpegOptimizeCoding    = flag.Bool("jpeg_optimize_coding", false, "Always compute optimal Huffman tables for JPEG output, at some CPU cost.")
+	jpegRestartInterval   = flag.Uint("jpeg_restart_interval", 0, "MCUs between JPEG restart markers, for lossy links (0 = none).")
+	jpegRGB               = flag.Bool("jpeg_rgb", false, "Save JPEG as RGB rather than YCbCr, with no chroma subsampling, for exact color at a much larger size; overrides -jpeg_keep_sampling.")
+	jpegKeepSampling      = flag.Bool("jpeg_keep_sampling", false, "Subsample the chroma of JPEG output as a JPEG source did, rather than by quality; -jpeg_rgb overrides this.")
+	jpegDctMethod         = flag.String("jpeg_dct_method", "", "DCT method for JPEG output: islow, ifast, float (\"\" = ImageMagick default).")
+	webpAlphaQuality      = flag.Uint("webp_alpha_quality", 100, "Quality of the alpha channel of WEBP output, from 0 to 100 (100 = lossless).")
+	webpLossless          = flag.Bool("webp_lossless", false, "Save WEBP output losslessly, with exact alpha, at a much larger size; overrides -webp_alpha_quality.")
+	bestEffortDecode      = flag.Bool("best_effort_decode", false, "Render whatever can be decoded from truncated images, rather than returning an error.")
+	borderColor           = flag.String("border_color", "white", "Color of the frame a \",border=\" option adds, like \"white\" or \"#333\".")
+	borderInside          = flag.Bool("border_inside", false, "Shrink images within a \",border=\" frame, so it's part of the size asked for, rather than adding to it.")
+	brokenProfile         = flag.String("broken_profile", "best_effort", "What to do with images whose embedded color profile can't be applied: best_effort converts them as if untagged, srgb takes them as sRGB, or reject.")
+	cropUpscale           = flag.String("crop_upscale", "clamp", "When a crop is larger than the image: clamp to the image size, allow enlarging, or reject.")
+	animatedOutput        = flag.Bool("animated_output", false, "Keep every frame of animated images, rather than one, chosen by -still_frame; animated PNGs are saved as APNG, if ImageMagick can.")
+	maxFrames             = flag.String("max_frames", "", "Per-format animation frame limits, like \"GIF=500,WEBP=100\" (\"\" = unlimited).")
+	maxAnimationPixels    = flag.Uint64("max_animation_pixels", 0, "Maximum pixels an animation may decode to, summed across its frames, however few or small they are (0 = unlimited).")
+	truncateFrames        = flag.Bool("truncate_frames", true, "Drop frames past -max_frames, rather than refusing the image.")
+	maxFramesByFormat     map[string]uint
+	jpegQualityCurve      = flag.String("jpeg_quality_curve", "", "JPEG quality by output size, like \"10000=70,1000000=85\" for 70 at 100x100 rising to 85 at 1000x1000 (\"\" = fixed quality).")
+	qualityCurve          []imager.QualityPoint
+	stillFrame            = flag.String("still_frame", "first", "Which frame of an animation to keep, when not keeping them all: first, best (the sharpest of up to -max_scored_frames), or a frame number from 0.")
+	stillFrameStrategy    imager.StillFrameStrategy
+	stillFrameIndex       uint
+	maxScoredFrames       = flag.Uint("max_scored_frames", 20, "Most frames of an animation -still_frame=best scores for sharpness, spread evenly across it (0 = all).")
+	assumeProfile         = flag.String("assume_profile", "", "ICC profile file to assume for untagged RGB images, like Adobe RGB (\"\" = sRGB).")
+	assumedProfile        []byte
+	assumeCMYKProfile     = flag.String("assume_cmyk_profile", "", "ICC profile file to assume for untagged CMYK images, like SWOP (\"\" = uncalibrated).")
+	assumedCMYKProfile    []byte
+	defines               = flag.String("defines", "", "Coder options to pass to ImageMagick, like \"png:compression-level=9,webp:method=6\", from an allowlist.")
+	definesMap            map[string]string
+	alwaysStrip           = flag.Bool("always_strip", false, "Re-encode even images that could be served as they are, so their EXIF, GPS and other metadata are always stripped.")
+	extensionFormat       = flag.Bool("extension_format", false, "Save images requested with a second extension, like \"/image.jpg.webp\", in that format.")
+	explainErrors         = flag.Bool("explain_errors", true, "Say what was wrong with a request in the body of a 400 (false = empty body).")
+	fallbackFormats       = flag.String("fallback_formats", "", "Formats to save in, in order of preference, when the usual one can't hold the result, like \"JPEG,PNG\" (\"\" = usual format regardless).")
+	fallbackFormatList    []string
+	smallestOpaque        = flag.Bool("smallest_opaque", false, "Save opaque JPEG and WEBP stills as both, serving whichever is smaller to clients that Accept image/webp, unless a format is asked for; costs a second encode.")
+	keepGrayscale         = flag.Bool("keep_grayscale", true, "Keep grayscale images single-channel, rather than promoting them to sRGB, unless color is added.")
+	keepXMP               = flag.Bool("keep_xmp", false, "Preserve XMP metadata, like rights and editing history, rather than stripping it.")
+	placeholderOnError    = flag.Bool("placeholder_on_error", false, "Answer failed fetches and renders with a 1x1 transparent PNG and a 200, logging the error.")
+	blurUpSize            = flag.Uint("blurup_size", 16, "Longest edge of the inline placeholder that /blurup/ returns.")
+	blurUpPalette         = flag.Uint("blurup_palette", 0, "Number of the image's most common colors that /blurup/ returns, for theming (0 = none).")
+	colorSampleSize       = flag.Uint("color_sample_size", 16, "Edge of the sample the colors /blurup/ returns are found in; larger is more accurate but slower (0 = every pixel).")
+	convertMinBytes       = flag.Int("convert_min_bytes", 0, "Save sources larger than this many bytes as -convert_format, to compress heavy originals harder (0 = never).")
+	convertFormat         = flag.String("convert_format", "WEBP", "Format to save sources larger than -convert_min_bytes in.")
+	convertQuality        = flag.Uint("convert_quality", 80, "Quality to save sources larger than -convert_min_bytes at.")
+	graphicFormat         = flag.String("graphic_format", "", "Format to save images that look like graphics, such as logos and screenshots, rather than photos in, like \"PNG\", unless a format is asked for (\"\" = usual format regardless).")
+	previewMinDimension   = flag.Uint("preview_min_dimension", 1, "Smallest width and height of images previews are made from; others need 2, as smaller ones are of no use.")
+	previewQuality        = flag.Uint("preview_quality", 40, "JPEG quality of previews, requested with a \"p\" prefix like \"=ps100x100\".")
+	progressive           = flag.Bool("progressive", true, "Save interlaced output, like progressive JPEGs, in formats -format_interlace doesn't set; previews always are.")
+	enableOperations      = flag.String("enable_operations", "", "Operations and options requests may use, like \"s,d,fm\" for only resizing and converting, from s, c, ar, d, f, t, cp, fm, p (preview), blur, border and pixel (\"\" = all).")
+	enabledOperations     map[string]bool
+	formatInterlace       = flag.String("format_interlace", "PNG=false", "Per-format override of -progressive, like \"PNG=true,GIF=false\"; PNG is only interlaced (Adam7) if asked (\"\" = -progressive for every format).")
+	interlaceByFormat     map[string]bool
+	progressiveMinPixels  = flag.Uint("progressive_min_pixels", 10000, "Save outputs with fewer pixels than this non-interlaced, but not previews, as it makes them smaller (0 = no minimum).")
+	embedSRGB             = flag.Bool("embed_srgb", false, "Tag output with a compact sRGB profile, for wide-gamut displays, at a cost of 580 bytes.")
+	wideGamut             = flag.Bool("wide_gamut", false, "Keep the colors of wide-gamut images in Display P3, tagged with a 588-byte profile, rather than clipping them to sRGB.")
+	blurAfterResize       = flag.Bool("blur_after_resize", false, "Blur images after resizing rather than before; faster, but coarser.")
+	cropHeader            = flag.Bool("crop_header", false, "Report the region kept by the last crop, as \"x,y,w,h\", in an X-Fotomat-Crop response header, for debugging.")
+	bytesHeader           = flag.Bool("bytes_header", false, "Report the encoded image size in an X-Fotomat-Bytes response header.")
+	sourceFormatHeader    = flag.Bool("source_format_header", false, "Report the original image format in an X-Fotomat-Source-Format response header.")
+	orientationHeader     = flag.Bool("orientation_header", false, "Report the original's EXIF orientation tag, 1 to 8 or 0 if untagged, in an X-Fotomat-Orientation response header, for auditing.")
+	upscaleSharpen        = flag.Bool("upscale_sharpen", false, "Lightly sharpen images that are enlarged, not just those that are shrunk.")
+	sharpenCurve          = flag.Float64("sharpen_curve", 0, "Sharpen more the more images shrink, by the ratio raised to this power, like 0.5 (0 = fixed amount).")
+	sharpenMaxAmount      = flag.Float64("sharpen_max_amount", 2, "Strongest unsharp mask amount -sharpen_curve may reach.")
+	lanczosThreshold      = flag.Float64("lanczos_threshold", 0.025, "Resize with Lanczos, rather than the faster Triangle, when shrinking by more than this fraction (0 = any shrink, negative = always).")
+	trimFuzz              = flag.Float64("trim_fuzz", 0.1, "How far from the color of a matte, as a fraction of full scale, pixels \"=t\" trims may be, ignoring noise in it.")
+	sharpenThreshold      = flag.Float64("sharpen_threshold", 0, "Only sharpen images shrunk by more than this ratio, like 1.5 (0 = always).")
+	outputDensity         = flag.Float64("output_density", 0, "Resolution in DPI to tag output images with (0 = leave untouched).")
+	maxDecodeThreads      = flag.Int("max_decode_threads", 0, "Maximum number of threads simultaneously decoding and resizing images (0 = the half of -max_image_threads not encoding, at least 1).")
+	maxEncodeThreads      = flag.Int("max_encode_threads", 0, "Maximum number of threads simultaneously encoding images (0 = half of -max_image_threads, at least 1).")
+	maxFetches            = flag.Int("max_fetches", 0, "Maximum number of source images fetched at once, answering 503 beyond that (0 = unlimited).")
+	fetchMaxIdleConns     = flag.Int("fetch_max_idle_conns", 100, "Maximum number of idle connections kept open to image sources, in all and to each host.")
+	fetchMaxConnsPerHost  = flag.Int("fetch_max_conns_per_host", 0, "Maximum number of connections to each image source host, with fetches beyond that waiting (0 = unlimited).")
+	decodePool            chan bool
+	encodePool            chan bool
+	fetchPool             chan bool
+	clientGone                           = errors.New("Client closed connection")
+	fetchesBusy                          = errors.New("Too many images being fetched")
 	transport             http.Transport = http.Transport{Proxy: http.ProxyFromEnvironment}
 	client                               = http.Client{Transport: http.RoundTripper(&transport)}
+	mux                                  = http.NewServeMux()
 )
 
 func init() {
-	http.HandleFunc("/", imageProxyHandler)
-	http.HandleFunc("/albums/crop", albumsCropHandler)
+	mux.HandleFunc("/", rateLimited(requestLimited(imageProxyHandler)))
+	mux.HandleFunc("/albums/crop", rateLimited(requestLimited(albumsCropHandler)))
 }
 
 func imageProxyHandler(w http.ResponseWriter, r *http.Request) {
@@ -37,12 +120,55 @@ func imageProxyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	path, preview, crop, width, height, ok := parsePath(r.URL.Path)
-	if !ok {
-		sendError(w, nil, 400)
+	path, params, err := parseImageURL(r.URL.Path, r.URL.Query())
+	if err == nil && r.URL.Query().Get("override") != "" {
+		params.overrides, err = parseOverride(r)
+	}
+	if err == overrideBadSignature {
+		sendError(w, err, http.StatusForbidden)
 		return
 	}
+	if err != nil {
+		sendBadRequest(w, err)
+		return
+	}
+
+	params.operations = scaleForDPR(w, r, params.operations)
+	params.acceptWebp = strings.Contains(r.Header.Get("Accept"), "image/webp")
+
+	fetchAndProcessImage(w, sourceURL(r, path), params)
+}
+
+// parseImageURL parses the path and query of an image URL into the path
+// of the source image and what to do with it.
+func parseImageURL(urlPath string, query url.Values) (string, imageParams, error) {
+	path, params, err := parsePath(urlPath)
+	if err == nil {
+		// Path URLs may ask for several formats at once.
+		if list := query.Get("formats"); list != "" {
+			params.formats, err = parseFormats(list)
+		}
+	} else if query.Get("w") != "" || query.Get("h") != "" || query.Get("op") != "" {
+		// Fall back to operations in the query string, if it has any, so
+		// unrelated parameters like cache busters don't hide the path's
+		// error.
+		path = urlPath
+		params, err = parseQuery(query)
+	}
+	if err == nil && *extensionFormat {
+		// An "=fm" operation is more explicit than an extension.
+		var format string
+		path, format, err = parseExtension(path)
+		if params.format == "" {
+			params.format = format
+		}
+	}
 
+	return path, params, err
+}
+
+// sourceURL returns where to fetch the original of an image at path.
+func sourceURL(r *http.Request, path string) string {
 	var u *url.URL
 	if *localImageDirectory == "" {
 		u = &url.URL{Scheme: "http", Host: r.Host, Path: path}
@@ -50,33 +176,540 @@ func imageProxyHandler(w http.ResponseWriter, r *http.Request) {
 		u = &url.URL{Scheme: "file", Host: "localhost", Path: path}
 	}
 
-	fetchAndProcessImage(w, u.String(), preview, crop, width, height)
+	return u.String()
+}
+
+var brokenProfilePolicies = map[string]imager.ProfilePolicy{
+	"best_effort": imager.ProfileBestEffort,
+	"srgb":        imager.ProfileAssumeSRGB,
+	"reject":      imager.ProfileReject,
+}
+
+var cropUpscalePolicies = map[string]imager.UpscalePolicy{
+	"clamp":  imager.UpscaleClamp,
+	"allow":  imager.UpscaleAllow,
+	"reject": imager.UpscaleReject,
+}
+
+// parseStillFrame parses -still_frame: "first", "best", or a frame number.
+func parseStillFrame(value string) (imager.StillFrameStrategy, uint, error) {
+	switch value {
+	case "first":
+		return imager.StillFirst, 0, nil
+	case "best":
+		return imager.StillBest, 0, nil
+	}
+
+	index, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return imager.StillFirst, 0, fmt.Errorf("%q isn't first, best, or a frame number", value)
+	}
+	return imager.StillIndex, uint(index), nil
+}
+
+// parseFormatLimits parses a list of per-format limits, like
+// "GIF=500,WEBP=100", refusing formats we can't save.
+func parseFormatLimits(list string) (map[string]uint, error) {
+	limits := map[string]uint{}
+	if list == "" {
+		return limits, nil
+	}
+
+	for _, item := range strings.Split(list, ",") {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Expected FORMAT=LIMIT, not %q", item)
+		}
+
+		format := strings.ToUpper(kv[0])
+		if !imager.CanEncode(format) {
+			return nil, fmt.Errorf("Unsupported format %q", kv[0])
+		}
+
+		limit, err := strconv.ParseUint(kv[1], 10, 0)
+		if err != nil {
+			return nil, fmt.Errorf("Bad limit for %s: %v", kv[0], err)
+		}
+
+		limits[format] = uint(limit)
+	}
+
+	return limits, nil
+}
+
+// parseFormatSwitches parses a list of per-format settings that are on or
+// off, like "PNG=false,GIF=false", refusing formats we can't save.
+func parseFormatSwitches(list string) (map[string]bool, error) {
+	switches := map[string]bool{}
+	if list == "" {
+		return switches, nil
+	}
+
+	for _, item := range strings.Split(list, ",") {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Expected FORMAT=BOOL, not %q", item)
+		}
+
+		format := strings.ToUpper(kv[0])
+		if !imager.CanEncode(format) {
+			return nil, fmt.Errorf("Unsupported format %q", kv[0])
+		}
+
+		on, err := strconv.ParseBool(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("Bad setting for %s: %v", kv[0], err)
+		}
+
+		switches[format] = on
+	}
+
+	return switches, nil
+}
+
+// Everything -enable_operations can enable, besides operationNames.
+var optionalOperations = map[string]bool{"fm": true, "p": true, "blur": true, "border": true, "pixel": true}
+
+// parseOperationList parses -enable_operations, returning nil to enable all.
+func parseOperationList(list string) (map[string]bool, error) {
+	if list == "" {
+		return nil, nil
+	}
+
+	enabled := map[string]bool{}
+	for _, name := range strings.Split(list, ",") {
+		if _, ok := operationNames[name]; !ok && !optionalOperations[name] {
+			return nil, fmt.Errorf("Unknown operation %q", name)
+		}
+		enabled[name] = true
+	}
+
+	return enabled, nil
+}
+
+// operationEnabled refuses operations and options -enable_operations leaves out.
+func operationEnabled(name string) error {
+	if enabledOperations != nil && !enabledOperations[name] {
+		return fmt.Errorf("Operation %q is disabled", name)
+	}
+	return nil
+}
+
+// parseQualityCurve parses a list of output sizes in pixels and the JPEG
+// quality to use at each, like "10000=70,1000000=85", smallest first.
+func parseQualityCurve(list string) ([]imager.QualityPoint, error) {
+	if list == "" {
+		return nil, nil
+	}
+
+	var curve []imager.QualityPoint
+	for _, item := range strings.Split(list, ",") {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Expected PIXELS=QUALITY, not %q", item)
+		}
+
+		pixels, err := strconv.ParseUint(kv[0], 10, 0)
+		if err != nil || pixels == 0 || (len(curve) > 0 && uint(pixels) <= curve[len(curve)-1].Pixels) {
+			return nil, fmt.Errorf("Pixels %q aren't more than the last", kv[0])
+		}
+
+		quality, err := strconv.ParseUint(kv[1], 10, 0)
+		if err != nil || quality < 1 || quality > 100 {
+			return nil, fmt.Errorf("Quality %q isn't from 1 to 100", kv[1])
+		}
+
+		curve = append(curve, imager.QualityPoint{Pixels: uint(pixels), Quality: uint(quality)})
+	}
+
+	return curve, nil
 }
 
-var matchPath = regexp.MustCompile(`^(/.*)=(p?)([sc])(\d{1,5})x(\d{1,5})$`)
+// parseDefines parses a list of coder options, like
+// "png:compression-level=9,webp:method=6", refusing any not allowed.
+func parseDefines(list string) (map[string]string, error) {
+	defines := map[string]string{}
+	if list == "" {
+		return defines, nil
+	}
 
-func parsePath(path string) (string, bool, bool, uint, uint, bool) {
-	g := matchPath.FindStringSubmatch(path)
-	if len(g) != 6 {
-		return "", false, false, 0, 0, false
+	for _, item := range strings.Split(list, ",") {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Expected KEY=VALUE, not %q", item)
+		}
+
+		if !imager.AllowedDefines[kv[0]] {
+			return nil, fmt.Errorf("%s: %v", kv[0], imager.ForbiddenDefine)
+		}
+
+		defines[kv[0]] = kv[1]
 	}
 
-	// Disallow repeated scaling parameters.
-	if matchPath.MatchString(g[1]) {
-		return "", false, false, 0, 0, false
+	return defines, nil
+}
+
+// imageParams describes the processing requested for an image.
+type imageParams struct {
+	preview    bool
+	quality    uint    // 0 = use default.
+	blur       float64 // 0 = use default.
+	pixel      bool    // Enlarge as pixel art.
+	border     uint    // Width of a frame around the output; 0 = none.
+	operations []imager.Operation
+	formats    []string   // Output formats of a multipart response; nil = one image.
+	format     string     // Output format from "=fm" or the path's extension; "" = usual.
+	overrides  *overrides // Settings a signed request changed; nil = none.
+	acceptWebp bool       // Whether the client's Accept lists WEBP.
+}
+
+// Upper bound on a requested blur factor.
+const maxBlurFactor = 10.0
+
+// Upper bound on a requested border width.
+const maxBorderWidth = 100
+
+var matchFormatOperation = regexp.MustCompile(`^(/.*)=fm([a-z0-9]*)$`)
+
+var matchPath = regexp.MustCompile(`^(/.*)=(p?)([scdft]|ar|cp)(\d{1,5})x(\d{1,5})((?:,[a-z]+=[0-9a-z.]+)*)$`)
+
+// Values of the pad option of "=s" and "=t" operations: "1" for a solid
+// color, or "blur" for a blurred copy of the image.
+var padModes = map[string]imager.PadMode{
+	"1":    imager.PadMatte,
+	"blur": imager.PadBlur,
+}
+
+// Values of the gravity option of "=f" operations.
+var gravities = map[string]imager.Gravity{
+	"c":  imager.GravityCenter,
+	"n":  imager.GravityNorth,
+	"ne": imager.GravityNorthEast,
+	"e":  imager.GravityEast,
+	"se": imager.GravitySouthEast,
+	"s":  imager.GravitySouth,
+	"sw": imager.GravitySouthWest,
+	"w":  imager.GravityWest,
+	"nw": imager.GravityNorthWest,
+}
+
+// parsePath splits an image path from the chain of operations suffixed to
+// it, like "/image.jpg=c400x400=s200x200", which are applied left to right.
+// Each operation may be followed by options, like "=s200x200,blur=2".
+// Besides scaling and cropping, "=ar16x9" crops to an aspect ratio, keeping
+// as much of the image as possible, and "=d200x200" only ever scales down,
+// serving the original as is if it's already small enough.  "=f200x200"
+// crops to fill like "=c", but keeps the part selected by a gravity option,
+// one of c, n, ne, e, se, s, sw, w or nw, like "=f200x200,gravity=ne".
+// "=t200x200" trims a matte within -trim_fuzz, then crops to fill like
+// "=c", or with "pad=1", like "=t200x200,pad=1", scales to fit and pads
+// with the matte to exactly that size.
+// "=fmwebp" saves in another format, one of those "?formats=" accepts,
+// either alone at full resolution or after other operations, like
+// "=s200x200=fmwebp".  A "p" prefix on any operation, like "=ps100x100",
+// asks for a preview: a blurry JPEG at -preview_quality.  The "pixel=1"
+// option enlarges pixel art by whole multiples without smoothing, so
+// "=s320x320,pixel=1" makes each pixel of a 32x32 sprite a 10x10 block.  As the multiple may not be able
+// to reach the size asked for, which -max_output_dimension still limits,
+// pixel art is scaled to the largest multiple that fits, or for crops the
+// smallest that covers before cropping.
+func parsePath(path string) (string, imageParams, error) {
+	var params imageParams
+	seen := map[string]bool{}
+
+	for {
+		if g := matchFormatOperation.FindStringSubmatch(path); g != nil {
+			if seen["fm"] {
+				return "", imageParams{}, fmt.Errorf("Format specified twice")
+			}
+			seen["fm"] = true
+			if err := operationEnabled("fm"); err != nil {
+				return "", imageParams{}, err
+			}
+
+			format, ok := multipartFormats[g[2]]
+			if !ok || !imager.CanEncode(format) {
+				return "", imageParams{}, fmt.Errorf("Unsupported format %q", g[2])
+			}
+			params.format = format
+			path = g[1]
+			continue
+		}
+
+		g := matchPath.FindStringSubmatch(path)
+		if len(g) != 7 {
+			break
+		}
+
+		if *maxOperations > 0 && len(params.operations) >= *maxOperations {
+			return "", imageParams{}, fmt.Errorf("More than %d operations", *maxOperations)
+		}
+
+		// Disallow repeated operations of the same type.
+		if seen[g[3]] {
+			return "", imageParams{}, fmt.Errorf("Operation %s specified twice", operationNames[g[3]])
+		}
+		seen[g[3]] = true
+
+		op, err := parseOperation(g[3], g[4], g[5])
+		if err != nil {
+			return "", imageParams{}, err
+		}
+
+		if g[2] == "p" {
+			if err := operationEnabled("p"); err != nil {
+				return "", imageParams{}, err
+			}
+			params.preview = true
+		}
+
+		for _, option := range strings.Split(g[6], ",")[1:] {
+			kv := strings.SplitN(option, "=", 2)
+			if kv[0] == "gravity" && (op.Type == imager.OpFill || op.Type == imager.OpCropPercent) {
+				gravity, ok := gravities[kv[1]]
+				if !ok {
+					return "", imageParams{}, fmt.Errorf("Unknown gravity %q", kv[1])
+				}
+				op.Gravity = gravity
+			} else if kv[0] == "pad" && (op.Type == imager.OpTrim || op.Type == imager.OpScale) {
+				pad, ok := padModes[kv[1]]
+				if !ok {
+					return "", imageParams{}, fmt.Errorf("Pad %q isn't 1 or blur", kv[1])
+				}
+				op.Pad = pad
+			} else if err := parseOption(&params, kv[0], kv[1]); err != nil {
+				return "", imageParams{}, err
+			}
+		}
+
+		// We're parsing right to left, so prepend.
+		params.operations = append([]imager.Operation{op}, params.operations...)
+		path = g[1]
 	}
 
-	width, err := strconv.Atoi(g[4])
-	if err != nil || width <= 0 || width > *maxOutputDimension {
-		return "", false, false, 0, 0, false
+	if len(params.operations) == 0 && params.format == "" {
+		return "", imageParams{}, badOperation(path)
 	}
 
-	height, err := strconv.Atoi(g[5])
-	if err != nil || height <= 0 || height > *maxOutputDimension {
-		return "", false, false, 0, 0, false
+	return path, params, nil
+}
+
+// parseExtension splits an output format extension from the end of path,
+// like "/image.jpg.webp", for -extension_format.  Only a second extension
+// after an image's own counts, so "/photo.2020.jpg" is left alone.
+func parseExtension(path string) (string, string, error) {
+	parts := strings.Split(path[strings.LastIndex(path, "/")+1:], ".")
+	if len(parts) < 3 {
+		return path, "", nil
 	}
+	if _, ok := multipartFormats[strings.ToLower(parts[len(parts)-2])]; !ok {
+		return path, "", nil
+	}
+
+	ext := parts[len(parts)-1]
+	format, ok := multipartFormats[strings.ToLower(ext)]
+	if !ok || !imager.CanEncode(format) {
+		return "", "", fmt.Errorf("Unsupported format %q", ext)
+	}
+
+	return strings.TrimSuffix(path, "."+ext), format, nil
+}
 
-	return g[1], (g[2] == "p"), (g[3] == "c"), uint(width), uint(height), true
+// Names of operations, for error messages.
+var operationNames = map[string]string{
+	"s":  "scale",
+	"c":  "crop",
+	"ar": "aspect ratio",
+	"d":  "downscale",
+	"f":  "fill",
+	"t":  "trim",
+	"cp": "percent crop",
+}
+
+var matchOperationKind = regexp.MustCompile(`=p?([a-z]*)[^=/]*$`)
+
+// badOperation explains why path has no operation parsePath understands.
+func badOperation(path string) error {
+	g := matchOperationKind.FindStringSubmatch(path)
+	if g == nil {
+		return fmt.Errorf("Missing operation, like \"=s200x200\"")
+	}
+	if _, ok := operationNames[g[1]]; !ok {
+		return fmt.Errorf("Unknown operation %q", g[1])
+	}
+	return fmt.Errorf("Malformed operation %q, expected like \"=%s200x200\"", g[0], g[1])
+}
+
+// parseQuery is the equivalent of parsePath for URLs like
+// "/image.jpg?w=200&h=200&op=crop&q=80":
+//
+//	w, h    - width and height, both required
+//	op      - "scale" (default) or "crop", as with "s" and "c" in the path
+//	q       - optional output quality, 1 to 100
+//	blur    - optional blur factor, as with ",blur=" in the path
+//	preview - "1" for a preview, as with the "p" prefix in the path
+func parseQuery(query url.Values) (imageParams, error) {
+	var params imageParams
+
+	kind := ""
+	switch op := query.Get("op"); op {
+	case "", "scale":
+		kind = "s"
+	case "crop":
+		kind = "c"
+	default:
+		return imageParams{}, fmt.Errorf("Unknown op %q", op)
+	}
+
+	op, err := parseOperation(kind, query.Get("w"), query.Get("h"))
+	if err != nil {
+		return imageParams{}, err
+	}
+	params.operations = []imager.Operation{op}
+
+	if q := query.Get("q"); q != "" {
+		quality, err := strconv.Atoi(q)
+		if err != nil || quality < 1 || quality > 100 {
+			return imageParams{}, fmt.Errorf("Quality %q isn't from 1 to 100", q)
+		}
+		params.quality = uint(quality)
+	}
+
+	if b := query.Get("blur"); b != "" {
+		if err := parseOption(&params, "blur", b); err != nil {
+			return imageParams{}, err
+		}
+	}
+
+	switch p := query.Get("preview"); p {
+	case "":
+	case "1":
+		if err := operationEnabled("p"); err != nil {
+			return imageParams{}, err
+		}
+		params.preview = true
+	default:
+		return imageParams{}, fmt.Errorf("Preview %q isn't 1", p)
+	}
+
+	return params, nil
+}
+
+// parseOption validates an option and records it in params, refusing repeats.
+func parseOption(params *imageParams, key, value string) error {
+	if optionalOperations[key] {
+		if err := operationEnabled(key); err != nil {
+			return err
+		}
+	}
+
+	switch key {
+	case "blur":
+		if params.blur != 0 {
+			return fmt.Errorf("Option blur specified twice")
+		}
+		blur, err := strconv.ParseFloat(value, 64)
+		if err != nil || blur <= 0 || blur > maxBlurFactor {
+			return fmt.Errorf("Blur %q isn't above 0 and at most %g", value, maxBlurFactor)
+		}
+		params.blur = blur
+		return nil
+	case "border":
+		if params.border != 0 {
+			return fmt.Errorf("Option border specified twice")
+		}
+		border, err := strconv.Atoi(value)
+		if err != nil || border < 1 || border > maxBorderWidth {
+			return fmt.Errorf("Border %q isn't from 1 to %d", value, maxBorderWidth)
+		}
+		params.border = uint(border)
+		return nil
+	case "gravity":
+		return fmt.Errorf("Option gravity only applies to fill and percent crop")
+	case "pad":
+		return fmt.Errorf("Option pad only applies to scale and trim")
+	case "pixel":
+		if params.pixel {
+			return fmt.Errorf("Option pixel specified twice")
+		}
+		if value != "1" {
+			return fmt.Errorf("Pixel %q isn't 1", value)
+		}
+		params.pixel = true
+		return nil
+	default:
+		return fmt.Errorf("Unknown option %q", key)
+	}
+}
+
+func parseOperation(kind, w, h string) (imager.Operation, error) {
+	if err := operationEnabled(kind); err != nil {
+		return imager.Operation{}, err
+	}
+
+	width, err := parseDimension("Width", w)
+	if err != nil {
+		return imager.Operation{}, err
+	}
+
+	height, err := parseDimension("Height", h)
+	if err != nil {
+		return imager.Operation{}, err
+	}
+
+	op := imager.Operation{Type: imager.OpScale, Width: uint(width), Height: uint(height)}
+	switch kind {
+	case "c":
+		op.Type = imager.OpCrop
+	case "ar":
+		op.Type = imager.OpAspect
+	case "d":
+		op.Type = imager.OpDownscale
+	case "f":
+		op.Type = imager.OpFill
+	case "t":
+		op.Type = imager.OpTrim
+	case "cp":
+		if width > 100 || height > 100 {
+			return imager.Operation{}, fmt.Errorf("Crop percentages %dx%d aren't from 1 to 100", width, height)
+		}
+		op.Type = imager.OpCropPercent
+	}
+
+	return op, nil
+}
+
+// parseDimension parses a width or height, from 1 to -max_output_dimension.
+func parseDimension(name, value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s %q isn't a number", name, value)
+	} else if n <= 0 {
+		return 0, fmt.Errorf("%s must be at least 1", name)
+	} else if n > *maxOutputDimension {
+		return 0, fmt.Errorf("%s %d exceeds max %d", name, n, *maxOutputDimension)
+	}
+	return n, nil
+}
+
+// parseAspectOperation is parseOperation for URL schemes where a zero width
+// or height means to follow the aspect ratio, which is how we scale to fit
+// within the maximum for that dimension.
+func parseAspectOperation(kind, w, h string) (imager.Operation, error) {
+	if w == "0" && h == "0" {
+		return imager.Operation{}, fmt.Errorf("Width and height can't both be 0")
+	}
+
+	if w == "0" || h == "0" {
+		kind = "s"
+		if w == "0" {
+			w = strconv.Itoa(*maxOutputDimension)
+		} else {
+			h = strconv.Itoa(*maxOutputDimension)
+		}
+	}
+
+	return parseOperation(kind, w, h)
 }
 
 func poolInit(limit int) {
@@ -84,10 +717,60 @@ func poolInit(limit int) {
 		transport.RegisterProtocol("file", http.NewFileTransport(http.Dir(*localImageDirectory)))
 	}
 
-	pool = make(chan bool, limit)
-	for i := 0; i < limit; i++ {
+	// Bound upstream connections apart from processing, so a burst of
+	// requests for new images doesn't open thousands.  Most come from one
+	// host, so it may keep all the idle ones.
+	transport.MaxIdleConns = *fetchMaxIdleConns
+	transport.MaxIdleConnsPerHost = *fetchMaxIdleConns
+	transport.MaxConnsPerHost = *fetchMaxConnsPerHost
+
+	// Split the threads between decoding and encoding, rather than
+	// allowing that many of each.
+	encodeThreads := limit / 2
+	if encodeThreads < 1 {
+		encodeThreads = 1
+	}
+	decodeThreads := limit - encodeThreads
+	if decodeThreads < 1 {
+		decodeThreads = 1
+	}
+	decodePool = newPool(*maxDecodeThreads, decodeThreads)
+	encodePool = newPool(*maxEncodeThreads, encodeThreads)
+	if *maxFetches > 0 {
+		fetchPool = newPool(*maxFetches, 0)
+	}
+}
+
+func newPool(size, fallback int) chan bool {
+	if size <= 0 {
+		size = fallback
+	}
+
+	pool := make(chan bool, size)
+	for i := 0; i < size; i++ {
 		pool <- true
 	}
+	return pool
+}
+
+// acquire waits for a thread to be available from pool, returning false if
+// the client closed its connection first.
+func acquire(pool chan bool, aborted <-chan bool) bool {
+	select {
+	case <-pool:
+	case <-aborted:
+		return false
+	}
+
+	// Did client close connection at the same time?
+	select {
+	case <-aborted:
+		pool <- true // Free up image thread ASAP.
+		return false
+	default:
+	}
+
+	return true
 }
 
 /*
@@ -108,69 +791,78 @@ func albumsCropHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	crop, width, height, ok := parseGeometry(r.FormValue("geometry"))
-	if !ok {
-		sendError(w, nil, 400)
+	op, err := parseGeometry(r.FormValue("geometry"))
+	if err != nil {
+		sendBadRequest(w, err)
 		return
 	}
 
-	fetchAndProcessImage(w, r.FormValue("image_url"), false, crop, width, height)
+	fetchAndProcessImage(w, r.FormValue("image_url"), imageParams{operations: []imager.Operation{op}})
 }
 
-func fetchAndProcessImage(w http.ResponseWriter, url string, preview, crop bool, width, height uint) {
+func fetchAndProcessImage(w http.ResponseWriter, url string, params imageParams) {
 	aborted := w.(http.CloseNotifier).CloseNotify()
 
 	orig, err, status := fetchUrl(url)
 	if err != nil || status != http.StatusOK {
-		sendError(w, err, status)
+		sendFailure(w, url, err, status)
 		return
 	}
 
-	// Wait for an image thread to be available.
-	<-pool
-
-	// Has client closed connection while we were waiting?
-	select {
-	case <-aborted:
-		pool <- true // Free up image thread ASAP.
-		sendError(w, nil, http.StatusRequestTimeout)
-		return
-	default:
-	}
-
-	thumb, err := processImage(url, orig, preview, crop, width, height)
+	thumb, err := processImage(url, orig, params, w.Header(), aborted)
 	orig = nil // Free up image memory ASAP.
 
-	pool <- true // Free up image thread ASAP.
-
 	if err != nil {
 		thumb = nil // Free up image memory ASAP.
-		sendError(w, err, 0)
+		sendFailure(w, url, err, 0)
 		return
 	}
 
+	if *bytesHeader {
+		w.Header().Set("X-Fotomat-Bytes", strconv.Itoa(len(thumb)))
+	}
+
+	// Multipart bodies have already said what they are.
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", contentType(thumb))
+	}
+
 	w.Write(thumb)
 	thumb = nil // Free up image memory ASAP.
 }
 
-func parseGeometry(geometry string) (bool, uint, uint, bool) {
+// contentType returns the media type of an image we saved, by its content
+// like net/http would, but also recognizing AVIF, which it doesn't.
+func contentType(blob []byte) string {
+	if len(blob) >= 12 && string(blob[4:12]) == "ftypavif" {
+		return "image/avif"
+	}
+	return http.DetectContentType(blob)
+}
+
+func parseGeometry(geometry string) (imager.Operation, error) {
 	g := matchGeometry.FindStringSubmatch(geometry)
 	if len(g) != 4 {
-		return false, 0, 0, false
-	}
-	width, err := strconv.Atoi(g[1])
-	if err != nil || width <= 0 || width > *maxOutputDimension {
-		return false, 0, 0, false
+		return imager.Operation{}, fmt.Errorf("Geometry %q isn't like WxH, WxH> or WxH#", geometry)
 	}
-	height, err := strconv.Atoi(g[2])
-	if err != nil || height <= 0 || height > *maxOutputDimension {
-		return false, 0, 0, false
+	kind := "s"
+	if g[3] == "#" {
+		kind = "c"
 	}
-	crop := (g[3] == "#")
-	return crop, uint(width), uint(height), true
+	return parseOperation(kind, g[1], g[2])
 }
 
 func fetchUrl(url string) ([]byte, error, int) {
+	// Shed load rather than queue behind slow sources.
+	if fetchPool != nil {
+		select {
+		case <-fetchPool:
+			defer func() { fetchPool <- true }()
+		default:
+			return nil, fetchesBusy, http.StatusServiceUnavailable
+		}
+	}
+
 	resp, err := client.Get(url)
 	if err != nil {
 		return nil, err, 0
@@ -199,7 +891,7 @@ func fetchUrl(url string) ([]byte, error, int) {
 	}
 }
 
-func processImage(url string, orig []byte, preview, crop bool, width, height uint) ([]byte, error) {
+func processImage(url string, orig []byte, params imageParams, header http.Header, aborted <-chan bool) ([]byte, error) {
 	if *maxProcessingDuration > 0 {
 		timer := time.AfterFunc(*maxProcessingDuration, func() {
 			panic(fmt.Sprintf("Processing %v longer than %v", url, *maxProcessingDuration))
@@ -207,28 +899,210 @@ func processImage(url string, orig []byte, preview, crop bool, width, height uin
 		defer timer.Stop()
 	}
 
-	img, err := imager.New(orig, *maxBufferPixels)
+	img, err := openImage(orig, params)
 	if err != nil {
 		return nil, err
 	}
 
 	defer img.Close()
 
+	if *sourceFormatHeader {
+		header.Set("X-Fotomat-Source-Format", img.InputFormat)
+	}
+	if *orientationHeader {
+		header.Set("X-Fotomat-Orientation", strconv.FormatUint(uint64(img.Orientation.Tag()), 10))
+	}
+
+	// Don't re-encode what's already small enough, unless its metadata
+	// mustn't be served or it's to be compressed harder.
+	if !*alwaysStrip && !params.preview && params.quality == 0 && img.Quality == 0 && params.blur == 0 && params.border == 0 && params.formats == nil && img.Unchanged(params.operations) {
+		return orig, nil
+	}
+
+	result, err := decodeImage(img, params.operations, aborted)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+	defer func() { encodePool <- true }()
+
+	if *cropHeader && result.Cropped != nil {
+		c := result.Cropped
+		header.Set("X-Fotomat-Crop", fmt.Sprintf("%d,%d,%d,%d", c.X, c.Y, c.Width, c.Height))
+	}
+
+	if params.formats != nil {
+		return getMultipart(result, params.formats, header)
+	}
+
+	// Only pick a format by size if none was asked for.
+	forced := params.format != "" || params.preview || (*convertMinBytes > 0 && len(orig) > *convertMinBytes)
+	if *smallestOpaque && !forced {
+		// Only offer WEBP to clients that say they take it, and tell
+		// caches that the answer depends on that.
+		header.Add("Vary", "Accept")
+		formats := []string{"JPEG"}
+		if params.acceptWebp {
+			formats = append(formats, "WEBP")
+		}
+		return result.GetSmallest(formats)
+	}
+
+	return result.Get()
+}
+
+// openImage reads the metadata of orig and configures how it will be
+// processed, from the flags and params.
+func openImage(orig []byte, params imageParams) (*imager.Imager, error) {
+	newImager := imager.New
+	if *downscaleOversize {
+		newImager = imager.NewDownscaling
+	}
+
+	img, err := newImager(orig, params.overrides.bufferPixels())
+	if err == imager.TooSmall && params.preview {
+		// A tiny image still makes a placeholder, scaled up.
+		img, err = imager.NewMinimum(orig, params.overrides.bufferPixels(), *previewMinDimension)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if params.preview && (img.Width < *previewMinDimension || img.Height < *previewMinDimension) {
+		img.Close()
+		return nil, imager.TooSmall
+	}
+
+	img.JpegOptimizeCoding = *jpegOptimizeCoding
+	img.JpegDctMethod = *jpegDctMethod
+	img.JpegRestartInterval = *jpegRestartInterval
+	img.JpegRGB = *jpegRGB
+	img.JpegKeepSampling = *jpegKeepSampling
+	img.WebpAlphaQuality = *webpAlphaQuality
+	img.WebpLossless = *webpLossless
+	img.Density = *outputDensity
+	img.BestEffort = *bestEffortDecode
+	img.MaxMemory = *maxImageMemory
+	img.SharpenThreshold = *sharpenThreshold
+	img.LanczosThreshold = *lanczosThreshold
+	img.TrimFuzz = *trimFuzz
+	img.SharpenCurve = *sharpenCurve
+	img.SharpenMaxAmount = *sharpenMaxAmount
+	img.UpscaleSharpen = *upscaleSharpen
+	img.CropUpscale = cropUpscalePolicies[*cropUpscale]
+	img.BrokenProfile = brokenProfilePolicies[*brokenProfile]
+	img.AnimatedOutput = *animatedOutput
+	img.MaxFrames = maxFramesByFormat
+	img.TruncateFrames = *truncateFrames
+	img.MaxAnimationPixels = *maxAnimationPixels
+	img.StillFrame = stillFrameStrategy
+	img.FrameIndex = stillFrameIndex
+	img.MaxScoredFrames = *maxScoredFrames
+	img.KeepXMP = *keepXMP
+	img.KeepGrayscale = *keepGrayscale
+	img.EmbedSRGB = *embedSRGB
+	img.WideGamut = *wideGamut
+	img.Defines = definesMap
+	img.FallbackFormats = fallbackFormatList
+	img.Progressive = *progressive
+	img.ProgressiveMinPixels = *progressiveMinPixels
+	img.Interlace = interlaceByFormat
+	img.BlurAfterResize = *blurAfterResize
+	img.AssumeProfile = assumedProfile
+	img.AssumeCMYKProfile = assumedCMYKProfile
+	img.ColorSampleSize = *colorSampleSize
+	params.overrides.apply(img)
+
+	// Compress heavy originals harder, leaving already small ones be.
+	if *convertMinBytes > 0 && len(orig) > *convertMinBytes {
+		img.OutputFormat = *convertFormat
+		img.Quality = *convertQuality
+	}
+	if params.format != "" {
+		img.OutputFormat = params.format
+	} else {
+		img.GraphicFormat = *graphicFormat
+	}
+
 	// Preview images are tiny, blurry JPEGs.
-	if preview {
+	if params.preview {
 		img.Sharpen = false
 		img.BlurFactor = 1.0
 		img.OutputFormat = "JPEG"
-		img.JpegQuality = 40
+		img.GraphicFormat = ""
+		img.Preview = true
+		img.PreviewQuality = *previewQuality
 	}
 
-	var thumb []byte
-	if crop {
-		thumb, err = img.Crop(width, height)
-	} else {
-		thumb, err = img.Thumbnail(width, height, true)
+	img.JpegQualityCurve = qualityCurve
+
+	// An explicit quality holds for every format.
+	if params.quality > 0 {
+		img.Quality = params.quality
+		img.PreviewQuality = params.quality
+	}
+	if params.blur > 0 {
+		img.BlurFactor = params.blur
+	}
+	img.PixelArt = params.pixel
+	img.BorderWidth = params.border
+	img.BorderColor = *borderColor
+	img.BorderInside = *borderInside
+
+	return img, nil
+}
+
+// decodeImage decompresses img and applies ops while holding a decode
+// thread, then trades it for an encode thread, which the caller must put
+// back.  Decoding and encoding have separate limits, so a burst of huge
+// decodes doesn't starve cheap encodes, or vice versa, but a decoded image
+// keeps its decode thread until it can be encoded, so no more of them wait
+// in memory than there are decode threads.
+func decodeImage(img *imager.Imager, ops []imager.Operation, aborted <-chan bool) (*imager.Result, error) {
+	if !acquire(decodePool, aborted) {
+		return nil, clientGone
+	}
+	defer func() { decodePool <- true }()
+
+	result, err := img.Decode(ops)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, op := range ops {
+		if err := result.Apply(op); err != nil {
+			result.Close()
+			return nil, err
+		}
 	}
-	return thumb, err
+
+	if !acquire(encodePool, aborted) {
+		result.Close()
+		return nil, clientGone
+	}
+
+	return result, nil
+}
+
+// A 1x1 fully-transparent PNG.
+const transparentPixel = "\x89\x50\x4e\x47\x0d\x0a\x1a\x0a\x00\x00\x00\x0d\x49\x48\x44\x52\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00\x1f\x15\xc4\x89\x00\x00\x00\x0e\x49\x44\x41\x54\x78\xda\x62\x62\x60\x60\x60\x00\x0c\x00\x00\x0f\x00\x03\xb1\x88\xf4\x0f\x00\x00\x00\x00\x49\x45\x4e\x44\xae\x42\x60\x82"
+
+// sendFailure reports that fetching or processing url failed, either with
+// an error or, if -placeholder_on_error, with a transparent pixel so embeds
+// degrade gracefully.
+func sendFailure(w http.ResponseWriter, url string, err error, status int) {
+	if !*placeholderOnError {
+		sendError(w, err, status)
+		return
+	}
+
+	// Log what went wrong, so it still shows up.
+	if err == nil {
+		err = errors.New(http.StatusText(status))
+	}
+	log.Printf("Serving placeholder for %s: %v", url, err)
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Write([]byte(transparentPixel))
 }
 
 func sendError(w http.ResponseWriter, err error, status int) {
@@ -238,6 +1112,26 @@ func sendError(w http.ResponseWriter, err error, status int) {
 			status = http.StatusUnsupportedMediaType
 		case imager.TooBig:
 			status = http.StatusRequestEntityTooLarge
+		case imager.Truncated:
+			status = http.StatusUnprocessableEntity
+		case imager.TooSmall:
+			status = http.StatusUnprocessableEntity
+		case imager.BadProfile:
+			status = http.StatusUnprocessableEntity
+		case imager.OverBudget:
+			status = http.StatusRequestEntityTooLarge
+		case imager.AnimationTooBig:
+			status = http.StatusRequestEntityTooLarge
+		case imager.TooManyFrames:
+			status = http.StatusRequestEntityTooLarge
+		case imager.WouldUpscale:
+			status = http.StatusBadRequest
+		case imager.NoOutput:
+			status = http.StatusInternalServerError
+		case clientGone:
+			status = http.StatusRequestTimeout
+		case fetchesBusy:
+			status = http.StatusServiceUnavailable
 		default:
 			status = http.StatusInternalServerError
 		}
@@ -247,3 +1141,13 @@ func sendError(w http.ResponseWriter, err error, status int) {
 	}
 	http.Error(w, err.Error(), status)
 }
+
+// sendBadRequest answers 400, saying what was wrong with the request,
+// unless -explain_errors is off.
+func sendBadRequest(w http.ResponseWriter, err error) {
+	if !*explainErrors {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	sendError(w, err, http.StatusBadRequest)
+}
@@ -5,15 +5,22 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/die-net/fotomat/imager"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net"
 	"net/http"
 	"runtime"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -35,7 +42,7 @@ func init() {
 	// Record that address.
 	localhost = listen.Addr().String()
 
-	go http.Serve(listen, nil)
+	go http.Serve(listen, mux)
 }
 
 func TestSuccess(t *testing.T) {
@@ -47,6 +54,481 @@ func TestSuccess(t *testing.T) {
 
 	// Scale preview JPEG.
 	assert.Nil(t, isSize("watermelon.jpg=ps100x100", "JPEG", 74, 100))
+
+	// Previews are upright, like anything else.
+	assert.Nil(t, isSize("orient6.jpg=ps40x40", "JPEG", 24, 40))
+
+	// Crop and then scale, in that order.
+	assert.Nil(t, isSize("watermelon.jpg=c200x100=s100x100", "JPEG", 100, 50))
+	assert.Nil(t, isSize("watermelon.jpg=s100x100=c50x50", "JPEG", 50, 50))
+
+	// Blur while scaling.
+	assert.Nil(t, isSize("watermelon.jpg=s100x100,blur=2", "JPEG", 74, 100))
+
+	// Only scale down, passing small enough images through untouched.
+	assert.Nil(t, isSize("watermelon.jpg=d200x200", "JPEG", 149, 200))
+	assert.Nil(t, isSize("2px.gif=d200x200", "PNG", 2, 3))
+	for _, filename := range []string{"watermelon.jpg", "2px.png"} {
+		body, code := fetch(filename + "=d1000x1000")
+		assert.Equal(t, code, 200)
+		orig, err := ioutil.ReadFile("imager/testdata/" + filename)
+		assert.Nil(t, err)
+		assert.Equal(t, body, orig, filename)
+	}
+
+	// Crop to an aspect ratio, keeping as much as possible.
+	assert.Nil(t, isSize("watermelon.jpg=ar16x9", "JPEG", 398, 224))
+	assert.Nil(t, isSize("watermelon.jpg=ar1x1=s100x100", "JPEG", 100, 100))
+
+	// Enlarge pixel art by whole multiples.
+	assert.Nil(t, isSize("2px.png=s320x320,pixel=1", "PNG", 212, 318))
+
+	// Crop to fill, keeping the part selected by gravity.
+	assert.Nil(t, isSize("watermelon.jpg=f200x100", "JPEG", 200, 100))
+	assert.Nil(t, isSize("watermelon.jpg=f200x100,gravity=sw", "JPEG", 200, 100))
+
+	// Query string equivalents of the above.
+	assert.Nil(t, isSize("watermelon.jpg?w=200&h=100&op=crop", "JPEG", 200, 100))
+	assert.Nil(t, isSize("watermelon.jpg?w=100&h=100&preview=1&q=30", "JPEG", 74, 100))
+
+	// Quality applies to formats other than JPEG too.
+	low, _ := fetch("flowers.png?w=100&h=100&q=10")
+	high, _ := fetch("flowers.png?w=100&h=100&q=95")
+	assert.NotEqual(t, low, high)
+}
+
+func TestMultipartFormats(t *testing.T) {
+	resp, err := http.Get("http://" + localhost + "/imager/testdata/watermelon.jpg=s100x100?formats=jpeg,webp,png")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+	mediaType, mediaParams, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	assert.Nil(t, err)
+	assert.Equal(t, mediaType, "multipart/mixed")
+
+	// Each part is the same image, in the formats asked for, in order.
+	mr := multipart.NewReader(resp.Body, mediaParams["boundary"])
+	for _, contentType := range []string{"image/jpeg", "image/webp", "image/png"} {
+		part, err := mr.NextPart()
+		assert.Nil(t, err)
+		assert.Equal(t, part.Header.Get("Content-Type"), contentType)
+
+		body, err := ioutil.ReadAll(part)
+		assert.Nil(t, err)
+		assert.Equal(t, http.DetectContentType(body), contentType)
+	}
+	_, err = mr.NextPart()
+	assert.Equal(t, err, io.EOF)
+
+	// Refuse formats we can't save, and repeats.
+	assert.Equal(t, status("watermelon.jpg=s100x100?formats=jpeg,tiff"), http.StatusBadRequest)
+	if !imager.CanEncode("AVIF") {
+		assert.Equal(t, status("watermelon.jpg=s100x100?formats=jpeg,avif"), http.StatusBadRequest)
+	}
+	assert.Equal(t, status("watermelon.jpg=s100x100?formats=jpeg,jpg"), http.StatusBadRequest)
+}
+
+func TestContentType(t *testing.T) {
+	jpeg, _ := ioutil.ReadFile("imager/testdata/watermelon.jpg")
+	assert.Equal(t, contentType(jpeg), "image/jpeg")
+	webp, _ := ioutil.ReadFile("imager/testdata/lossy.webp")
+	assert.Equal(t, contentType(webp), "image/webp")
+	assert.Equal(t, contentType([]byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00")), "image/avif")
+
+	// Single images say what they are too.
+	resp, err := http.Get("http://" + localhost + "/imager/testdata/watermelon.jpg=s100x100")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, resp.Header.Get("Content-Type"), "image/jpeg")
+}
+
+func TestBlurUp(t *testing.T) {
+	resp, err := http.Get("http://" + localhost + "/blurup/imager/testdata/watermelon.jpg=s100x100")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Equal(t, resp.Header.Get("Content-Type"), "application/json")
+
+	var b blurUp
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&b))
+	assert.Equal(t, b.URL, "http://"+localhost+"/imager/testdata/watermelon.jpg=s100x100")
+	assert.Equal(t, b.Width, uint(74))
+	assert.Equal(t, b.Height, uint(100))
+	assert.Equal(t, len(b.Color), 7)
+	assert.Nil(t, b.Palette)
+
+	// The placeholder is a tiny JPEG.
+	assert.True(t, strings.HasPrefix(b.Placeholder, "data:image/jpeg;base64,"))
+	thumb, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(b.Placeholder, "data:image/jpeg;base64,"))
+	assert.Nil(t, err)
+	img, err := imager.New(thumb, 10000000)
+	assert.Nil(t, err)
+	defer img.Close()
+	assert.Equal(t, img.Width, uint(12))
+	assert.Equal(t, img.Height, uint(16))
+
+	// With a palette, if asked, led by the dominant color.
+	*blurUpPalette = 3
+	resp, err = http.Get("http://" + localhost + "/blurup/imager/testdata/watermelon.jpg=s100x100")
+	assert.Nil(t, err)
+	b = blurUp{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&b))
+	resp.Body.Close()
+	assert.Equal(t, len(b.Palette), 3)
+	assert.Equal(t, b.Palette[0], b.Color)
+	*blurUpPalette = 0
+
+	// Its URL is for clients, wherever we're behind.
+	*baseURL = "https://img.example.com"
+	resp, err = http.Get("http://" + localhost + "/blurup/imager/testdata/watermelon.jpg=s100x100")
+	assert.Nil(t, err)
+	b = blurUp{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&b))
+	resp.Body.Close()
+	assert.Equal(t, b.URL, "https://img.example.com/imager/testdata/watermelon.jpg=s100x100")
+	*baseURL = ""
+
+	// Validated like any other image URL.
+	resp, err = http.Get("http://" + localhost + "/blurup/imager/testdata/watermelon.jpg=z16x16")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+}
+
+func TestValidate(t *testing.T) {
+	validate := func(path string) (validation, int) {
+		resp, err := http.Get("http://" + localhost + "/validate" + path)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, resp.Header.Get("Content-Type"), "application/json")
+
+		var v validation
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&v))
+		return v, resp.StatusCode
+	}
+
+	// Images that don't exist aren't fetched, so don't matter.
+	v, code := validate("/nonexistent.jpg=f200x100,gravity=ne,blur=2=fmwebp")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, v.Path, "/nonexistent.jpg")
+	assert.Equal(t, v.Format, "WEBP")
+	assert.Equal(t, v.Blur, 2.0)
+	assert.Equal(t, v.Operations, []validatedOperation{{Type: "fill", Width: 200, Height: 100, Gravity: "ne"}})
+
+	v, code = validate("/nonexistent.jpg?w=100&h=50&op=crop")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, v.Operations, []validatedOperation{{Type: "crop", Width: 100, Height: 50}})
+
+	v, code = validate("/nonexistent.jpg=cp50x100,gravity=e")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, v.Operations, []validatedOperation{{Type: "percent crop", Width: 50, Height: 100, Gravity: "e"}})
+
+	// Refused as they would be, with the reason.
+	v, code = validate("/nonexistent.jpg=s9999x100")
+	assert.Equal(t, code, http.StatusBadRequest)
+	assert.NotEqual(t, v.Error, "")
+	assert.Nil(t, v.Operations)
+
+	// Whatever else is in the query.
+	busted, code := validate("/nonexistent.jpg=s9999x100?v=2")
+	assert.Equal(t, code, http.StatusBadRequest)
+	assert.Equal(t, busted.Error, v.Error)
+
+	enabledOperations = map[string]bool{"s": true}
+	v, code = validate("/nonexistent.jpg=c100x100")
+	enabledOperations = nil
+	assert.Equal(t, code, http.StatusBadRequest)
+	assert.Equal(t, v.Error, `Operation "c" is disabled`)
+}
+
+func TestContactSheet(t *testing.T) {
+	sheet := func(path string) ([]byte, int) {
+		resp, err := http.Get("http://" + localhost + "/contactsheet/imager/testdata/" + path)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		return body, resp.StatusCode
+	}
+
+	body, code := sheet("animated.gif=s20x20?columns=1")
+	assert.Equal(t, code, http.StatusOK)
+	img, err := imager.New(body, 10000000)
+	assert.Nil(t, err)
+	defer img.Close()
+	assert.Equal(t, img.Frames, uint(1))
+	assert.Equal(t, img.Width, uint(13))
+	assert.True(t, img.Height > 20)
+
+	for _, path := range []string{"animated.gif=c20x20", "animated.gif=s20x20=s10x10", "animated.gif=s20x20?columns=x"} {
+		_, code = sheet(path)
+		assert.Equal(t, code, http.StatusBadRequest, path)
+	}
+}
+
+func TestConvertMinBytes(t *testing.T) {
+	if !imager.CanEncode("WEBP") {
+		return
+	}
+
+	// watermelon.jpg is 48KB, 2px.png only 86 bytes.
+	*convertMinBytes = 1000
+	assert.Nil(t, isSize("watermelon.jpg=s100x100", "WEBP", 74, 100))
+	assert.Nil(t, isSize("2px.png=s100x100", "PNG", 2, 3))
+
+	// An explicit quality still wins.
+	heavy, _ := fetch("watermelon.jpg=s100x100")
+	light, _ := fetch("watermelon.jpg?w=100&h=100&q=20")
+	assert.True(t, len(light) < len(heavy))
+
+	// Converting to the same format still re-encodes at that quality.
+	*convertFormat = "JPEG"
+	orig, _ := ioutil.ReadFile("imager/testdata/watermelon.jpg")
+	converted, _ := fetch("watermelon.jpg=d1000x1000")
+	assert.NotEqual(t, converted, orig)
+	*convertFormat = "WEBP"
+	*convertMinBytes = 0
+}
+
+func TestJpegOptions(t *testing.T) {
+	plain, _ := fetch("watermelon.jpg=s200x200")
+
+	*jpegOptimizeCoding = true
+	optimized, _ := fetch("watermelon.jpg=s200x200")
+	assert.True(t, len(optimized) <= len(plain))
+	*jpegOptimizeCoding = false
+
+	*jpegDctMethod = "float"
+	float, _ := fetch("watermelon.jpg=s200x200")
+	assert.NotEqual(t, float, plain)
+	*jpegDctMethod = ""
+}
+
+func TestOutputDensity(t *testing.T) {
+	plain, _ := fetch("watermelon.jpg=s200x200")
+
+	*outputDensity = 300
+	tagged, _ := fetch("watermelon.jpg=s200x200")
+	assert.NotEqual(t, tagged, plain)
+	*outputDensity = 0
+}
+
+func TestGraphicFormat(t *testing.T) {
+	*graphicFormat = "GIF"
+	assert.Nil(t, isSize("graphic.png=s100x100", "GIF", 100, 50))
+	assert.Nil(t, isSize("watermelon.jpg=s100x100", "JPEG", 74, 100))
+
+	// An explicit format still wins.
+	assert.Nil(t, isSize("graphic.png=s100x100=fmpng", "PNG", 100, 50))
+	*graphicFormat = ""
+}
+
+func TestExtensionFormat(t *testing.T) {
+	// Without -extension_format, the extension is part of the filename.
+	assert.Equal(t, status("watermelon.jpg.png=s100x100"), http.StatusNotFound)
+
+	*extensionFormat = true
+	defer func() { *extensionFormat = false }()
+
+	assert.Nil(t, isSize("watermelon.jpg.png=s100x100", "PNG", 74, 100))
+	assert.Nil(t, isSize("watermelon.jpg.jpeg=s100x100", "JPEG", 74, 100))
+	assert.Equal(t, status("watermelon.jpg.tiff=s100x100"), http.StatusBadRequest)
+
+	path, format, err := parseExtension("/photo.2020.jpg")
+	assert.Nil(t, err)
+	assert.Equal(t, path, "/photo.2020.jpg")
+	assert.Equal(t, format, "")
+}
+
+func TestFormatOperation(t *testing.T) {
+	// Alone, it converts at full resolution.
+	assert.Nil(t, isSize("watermelon.jpg=fmpng", "PNG", 398, 536))
+	assert.Nil(t, isSize("watermelon.jpg=s100x100=fmpng", "PNG", 74, 100))
+	assert.Nil(t, isSize("watermelon.jpg=fmgif=s100x100", "GIF", 74, 100))
+
+	// Converting an image to its own format changes nothing.
+	orig, err := ioutil.ReadFile("imager/testdata/watermelon.jpg")
+	assert.Nil(t, err)
+	body, _ := fetch("watermelon.jpg=fmjpg")
+	assert.Equal(t, body, orig)
+}
+
+func TestBorderOption(t *testing.T) {
+	assert.Nil(t, isSize("watermelon.jpg=s100x100,border=4", "JPEG", 82, 108))
+
+	// Even images that would otherwise be served as they are get one.
+	assert.Nil(t, isSize("watermelon.jpg=d1000x1000,border=4", "JPEG", 406, 544))
+
+	*borderInside = true
+	defer func() { *borderInside = false }()
+	assert.Nil(t, isSize("watermelon.jpg=s100x100,border=4", "JPEG", 74, 100))
+}
+
+func TestCropPercentOperation(t *testing.T) {
+	assert.Nil(t, isSize("watermelon.jpg=cp50x50", "JPEG", 199, 268))
+	assert.Nil(t, isSize("watermelon.jpg=cp50x100,gravity=e=s100x100", "JPEG", 37, 100))
+	assert.Equal(t, status("watermelon.jpg=cp101x50"), http.StatusBadRequest)
+}
+
+func TestPadOption(t *testing.T) {
+	assert.Nil(t, isSize("watermelon.jpg=s100x50,pad=1", "JPEG", 100, 50))
+	assert.Nil(t, isSize("watermelon.jpg=s100x50,pad=blur", "JPEG", 100, 50))
+	assert.Equal(t, status("watermelon.jpg=s100x50,pad=2"), http.StatusBadRequest)
+	assert.Equal(t, status("watermelon.jpg=c100x50,pad=1"), http.StatusBadRequest)
+}
+
+func TestTrimOperation(t *testing.T) {
+	assert.Nil(t, isSize("matte.png=t16x8", "PNG", 16, 8))
+	assert.Nil(t, isSize("matte.png=t16x8,pad=1", "PNG", 16, 8))
+	assert.Equal(t, status("matte.png=s16x8,pad=1"), http.StatusBadRequest)
+	assert.Equal(t, status("matte.png=t16x8,pad=2"), http.StatusBadRequest)
+}
+
+func TestBytesHeader(t *testing.T) {
+	*bytesHeader = true
+	defer func() { *bytesHeader = false }()
+
+	resp, err := http.Get("http://" + localhost + "/imager/testdata/watermelon.jpg=s100x100")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, resp.Header.Get("X-Fotomat-Bytes"), strconv.Itoa(len(body)))
+}
+
+func TestCropHeader(t *testing.T) {
+	*cropHeader = true
+	defer func() { *cropHeader = false }()
+
+	resp, err := http.Get("http://" + localhost + "/imager/testdata/watermelon.jpg=ar1x1")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, resp.Header.Get("X-Fotomat-Crop"), "0,69,398,398")
+
+	// Nothing to report without a crop.
+	resp, err = http.Get("http://" + localhost + "/imager/testdata/watermelon.jpg=s100x100")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, resp.Header.Get("X-Fotomat-Crop"), "")
+}
+
+func TestAlwaysStrip(t *testing.T) {
+	orig, err := ioutil.ReadFile("imager/testdata/exifthumb.jpg")
+	assert.Nil(t, err)
+
+	// An image that already fits is served as it is, metadata and all.
+	body, code := fetch("exifthumb.jpg=d2048x2048")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, body, orig)
+
+	*alwaysStrip = true
+	body, code = fetch("exifthumb.jpg=d2048x2048")
+	assert.Equal(t, code, http.StatusOK)
+	assert.False(t, strings.Contains(string(body), "Exif\x00\x00"))
+	*alwaysStrip = false
+}
+
+func TestSourceFormatHeader(t *testing.T) {
+	*sourceFormatHeader = true
+	defer func() { *sourceFormatHeader = false }()
+
+	resp, err := http.Get("http://" + localhost + "/imager/testdata/flowers.png=s100x100")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, resp.Header.Get("X-Fotomat-Source-Format"), "PNG")
+}
+
+func TestOrientationHeader(t *testing.T) {
+	*orientationHeader = true
+	defer func() { *orientationHeader = false }()
+
+	resp, err := http.Get("http://" + localhost + "/imager/testdata/orient6.jpg=s40x40")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, resp.Header.Get("X-Fotomat-Orientation"), "6")
+
+	// Untagged images say so.
+	resp, err = http.Get("http://" + localhost + "/imager/testdata/flowers.png=s100x100")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, resp.Header.Get("X-Fotomat-Orientation"), "0")
+}
+
+func TestSmallestOpaque(t *testing.T) {
+	if !imager.CanEncode("WEBP") {
+		return
+	}
+
+	*smallestOpaque = true
+	defer func() { *smallestOpaque = false }()
+
+	get := func(accept string) (string, http.Header) {
+		req, err := http.NewRequest("GET", "http://"+localhost+"/imager/testdata/watermelon.jpg=s100x100", nil)
+		assert.Nil(t, err)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		return http.DetectContentType(body), resp.Header
+	}
+
+	// Clients that don't take WEBP are only given JPEG, and caches told.
+	format, header := get("")
+	assert.Equal(t, format, "image/jpeg")
+	assert.Equal(t, header.Get("Vary"), "Accept")
+
+	format, _ = get("image/webp,*/*")
+	assert.Contains(t, []string{"image/jpeg", "image/webp"}, format)
+}
+
+func TestDPRHeader(t *testing.T) {
+	*dprHeader = "Sec-CH-DPR"
+	defer func() { *dprHeader = "" }()
+
+	dpr := func(ratio string) (uint, uint, http.Header) {
+		req, err := http.NewRequest("GET", "http://"+localhost+"/imager/testdata/watermelon.jpg=s100x100", nil)
+		assert.Nil(t, err)
+		if ratio != "" {
+			req.Header.Set("Sec-CH-DPR", ratio)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		img, err := imager.New(body, 10000000)
+		assert.Nil(t, err)
+		defer img.Close()
+		return img.Width, img.Height, resp.Header
+	}
+
+	// Without a ratio, the size asked for, but caches are told it varies.
+	w, h, header := dpr("")
+	assert.Equal(t, w, uint(74))
+	assert.Equal(t, h, uint(100))
+	assert.Equal(t, header.Get("Vary"), "Sec-CH-DPR")
+
+	// Ratios are rounded to whole numbers, up to -max_dpr.
+	w, h, _ = dpr("1.25")
+	assert.Equal(t, w, uint(74))
+	assert.Equal(t, h, uint(100))
+	w, h, _ = dpr("2.625")
+	assert.Equal(t, w, uint(149))
+	assert.Equal(t, h, uint(200))
+	w, h, _ = dpr("3")
+	assert.Equal(t, w, uint(149))
+	assert.Equal(t, h, uint(200))
+
+	// Garbage is ignored.
+	w, h, _ = dpr("retina")
+	assert.Equal(t, w, uint(74))
+	assert.Equal(t, h, uint(100))
 }
 
 func TestResponseErrors(t *testing.T) {
@@ -56,14 +538,91 @@ func TestResponseErrors(t *testing.T) {
 	// Return StatusUnsupportedMediaType on a text file.
 	assert.Equal(t, status("notimage.txt=s16x16"), http.StatusUnsupportedMediaType)
 
-	// Return StatusUnsupportedMediaType on a truncated image.
-	assert.Equal(t, status("bad.jpg=s16x16"), http.StatusUnsupportedMediaType)
+	// And on vector images disguised as JPEGs.
+	assert.Equal(t, status("svg.jpg=s16x16"), http.StatusUnsupportedMediaType)
+	assert.Equal(t, status("mvg.jpg=s16x16"), http.StatusUnsupportedMediaType)
 
-	// Return StatusUnsupportedMediaType on a 1x1 pixel image.
-	assert.Equal(t, status("1px.png=s16x16"), http.StatusUnsupportedMediaType)
+	// Return StatusUnprocessableEntity on a truncated image.
+	assert.Equal(t, status("bad.jpg=s16x16"), http.StatusUnprocessableEntity)
+
+	// Return StatusUnprocessableEntity, saying why, on a 1x1 pixel image.
+	body, code := fetch("1px.png=s16x16")
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+	assert.Equal(t, strings.TrimSpace(string(body)), imager.TooSmall.Error())
+
+	// But it still makes a preview, unless -preview_min_dimension says not.
+	assert.Nil(t, isSize("1px.png=ps16x16", "JPEG", 16, 16))
+	*previewMinDimension = 2
+	assert.Equal(t, status("1px.png=ps16x16"), http.StatusUnprocessableEntity)
+	*previewMinDimension = 1
+
+	// Return StatusUnprocessableEntity on a broken color profile, if asked.
+	*brokenProfile = "reject"
+	assert.Equal(t, status("badprofile.jpg=s16x16"), http.StatusUnprocessableEntity)
+	*brokenProfile = "best_effort"
+	assert.Equal(t, status("badprofile.jpg=s16x16"), http.StatusOK)
 
 	// Return StatusRequestEntityTooLarge on a 34000px image.
 	assert.Equal(t, status("34000px.png=s16x16"), http.StatusRequestEntityTooLarge)
+
+	// And when an intermediate step of a chain is too large.
+	*maxBufferPixels = 1000000
+	assert.Equal(t, status("watermelon.jpg=s2000x2000=s100x100"), http.StatusRequestEntityTooLarge)
+	*maxBufferPixels = 6500000
+}
+
+func TestMaxFetches(t *testing.T) {
+	fetchPool = newPool(1, 0)
+	defer func() { fetchPool = nil }()
+	assert.Nil(t, isSize("watermelon.jpg=s100x100", "JPEG", 74, 100))
+
+	// Fetches beyond the limit are refused, not queued.
+	<-fetchPool
+	assert.Equal(t, status("watermelon.jpg=s100x100"), http.StatusServiceUnavailable)
+	fetchPool <- true
+	assert.Equal(t, status("watermelon.jpg=s100x100"), http.StatusOK)
+}
+
+func TestDownscaleOversize(t *testing.T) {
+	*maxBufferPixels = 10000
+	*downscaleOversize = true
+	defer func() { *maxBufferPixels = 6500000; *downscaleOversize = false }()
+
+	// Huge JPEGs are downscaled to fit rather than refused.
+	assert.Nil(t, isSize("watermelon.jpg=s200x200", "JPEG", 49, 67))
+
+	// Others still are.
+	assert.Equal(t, status("34000px.png=s16x16"), http.StatusRequestEntityTooLarge)
+}
+
+func TestPlaceholderOnError(t *testing.T) {
+	*placeholderOnError = true
+	defer func() { *placeholderOnError = false }()
+
+	// Failed renders and fetches get a transparent pixel.
+	for _, filename := range []string{"bad.jpg=s16x16", "notimage.txt=s16x16", "missing.jpg=s16x16"} {
+		body, code := fetch(filename)
+		assert.Equal(t, code, http.StatusOK, filename)
+		assert.Equal(t, string(body), transparentPixel, filename)
+	}
+
+	// Successes and bad requests are unaffected.
+	assert.Nil(t, isSize("watermelon.jpg=s100x100", "JPEG", 74, 100))
+	assert.Equal(t, status("watermelon.jpg=s0x10"), http.StatusBadRequest)
+}
+
+func TestRequestLimits(t *testing.T) {
+	// Refuse overly long operation strings before doing anything else.
+	long := "watermelon.jpg" + strings.Repeat("=s16x16", 1000)
+	assert.Equal(t, status(long), http.StatusRequestURITooLong)
+
+	// And overly large bodies.
+	*maxBodyBytes = 10
+	resp, err := http.Post("http://"+localhost+"/imager/testdata/watermelon.jpg=s16x16", "text/plain", strings.NewReader("01234567890"))
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusRequestEntityTooLarge)
+	*maxBodyBytes = 10485760
 }
 
 func TestParameterValidation(t *testing.T) {
@@ -81,6 +640,7 @@ func TestParameterValidation(t *testing.T) {
 	assert.Equal(t, status("watermelon.jpg=s10x0"), http.StatusBadRequest)
 	assert.Equal(t, status("watermelon.jpg=c0x10"), http.StatusBadRequest)
 	assert.Equal(t, status("watermelon.jpg=c10x0"), http.StatusBadRequest)
+	assert.Equal(t, status("watermelon.jpg=ar0x9"), http.StatusBadRequest)
 
 	// Test that both scale and crop refuse a 2049px width or height.
 	assert.Equal(t, status("watermelon.jpg=s2049x16"), http.StatusBadRequest)
@@ -90,6 +650,170 @@ func TestParameterValidation(t *testing.T) {
 
 	// Refuse repeated scale parameters.
 	assert.Equal(t, status("watermelon.jpg=s16x16=s16x16"), http.StatusBadRequest)
+	assert.Equal(t, status("watermelon.jpg=c16x16=s8x8=c16x16"), http.StatusBadRequest)
+
+	// Validate query string parameters the same way.
+	assert.Equal(t, status("watermelon.jpg?w=2049&h=16"), http.StatusBadRequest)
+	assert.Equal(t, status("watermelon.jpg?w=16&h=16&op=zoom"), http.StatusBadRequest)
+	assert.Equal(t, status("watermelon.jpg?w=16&h=16&q=101"), http.StatusBadRequest)
+	assert.Equal(t, status("watermelon.jpg?w=16"), http.StatusBadRequest)
+
+	// Validate blur options.
+	assert.Equal(t, status("watermelon.jpg=s16x16,blur=0"), http.StatusBadRequest)
+	assert.Equal(t, status("watermelon.jpg=s16x16,blur=11"), http.StatusBadRequest)
+	assert.Equal(t, status("watermelon.jpg=s16x16,blur=1,blur=2"), http.StatusBadRequest)
+	assert.Equal(t, status("watermelon.jpg=s16x16,fuzz=1"), http.StatusBadRequest)
+	assert.Equal(t, status("watermelon.jpg?w=16&h=16&blur=x"), http.StatusBadRequest)
+
+	// Validate pixel art options.
+	assert.Equal(t, status("2px.png=s320x320,pixel=2"), http.StatusBadRequest)
+	assert.Equal(t, status("2px.png=s320x320,pixel=1,pixel=1"), http.StatusBadRequest)
+
+	// Validate gravity, which only fills take.
+	assert.Equal(t, status("watermelon.jpg=f16x16,gravity=up"), http.StatusBadRequest)
+	assert.Equal(t, status("watermelon.jpg=c16x16,gravity=n"), http.StatusBadRequest)
+
+	// Validate every operation in a chain.
+	assert.Equal(t, status("watermelon.jpg=c2049x16=s16x16"), http.StatusBadRequest)
+
+	// Limit how many operations may be chained.
+	assert.Equal(t, status("watermelon.jpg=c200x200=s100x100=d90x90=f80x80"), http.StatusOK)
+	assert.Equal(t, status("watermelon.jpg=c200x200=s100x100=d90x90=f80x80=ar1x1"), http.StatusBadRequest)
+	*maxOperations = 1
+	assert.Equal(t, status("watermelon.jpg=c200x200=s100x100"), http.StatusBadRequest)
+	*maxOperations = 0
+	assert.Equal(t, status("watermelon.jpg=c200x200=s100x100=d90x90=f80x80=ar1x1"), http.StatusOK)
+	*maxOperations = 4
+}
+
+func TestValidationMessages(t *testing.T) {
+	message := func(filename string) string {
+		body, code := fetch(filename)
+		assert.Equal(t, code, http.StatusBadRequest, filename)
+		return strings.TrimSpace(string(body))
+	}
+
+	assert.Equal(t, message("watermelon.jpg"), `Missing operation, like "=s200x200"`)
+	assert.Equal(t, message("watermelon.jpg=z16x16"), `Unknown operation "z"`)
+	assert.Equal(t, message("watermelon.jpg=s16x"), `Malformed operation "=s16x", expected like "=s200x200"`)
+	assert.Equal(t, message("watermelon.jpg=s2049x16"), "Width 2049 exceeds max 2048")
+	assert.Equal(t, message("watermelon.jpg=c16x0"), "Height must be at least 1")
+	assert.Equal(t, message("watermelon.jpg=s16x16=s8x8"), "Operation scale specified twice")
+	assert.Equal(t, message("watermelon.jpg=c16x16=s8x8=d8x8=f8x8=ar1x1"), "More than 4 operations")
+	assert.Equal(t, message("watermelon.jpg=s16x16,fuzz=1"), `Unknown option "fuzz"`)
+	assert.Equal(t, message("watermelon.jpg=s16x16,blur=1,blur=2"), "Option blur specified twice")
+	assert.Equal(t, message("watermelon.jpg=f16x16,gravity=up"), `Unknown gravity "up"`)
+	assert.Equal(t, message("watermelon.jpg?w=16&h=16&op=zoom"), `Unknown op "zoom"`)
+	assert.Equal(t, message("watermelon.jpg=s16x16?formats=tiff"), `Unsupported format "tiff"`)
+	assert.Equal(t, message("watermelon.jpg=fmtiff"), `Unsupported format "tiff"`)
+	assert.Equal(t, message("watermelon.jpg=fmpng=s16x16=fmgif"), "Format specified twice")
+
+	// Some clients need an empty body.
+	*explainErrors = false
+	assert.Equal(t, message("watermelon.jpg=z16x16"), "")
+	*explainErrors = true
+}
+
+func TestParseFormatLimits(t *testing.T) {
+	limits, err := parseFormatLimits("gif=500,WEBP=100")
+	assert.Nil(t, err)
+	assert.Equal(t, limits, map[string]uint{"GIF": 500, "WEBP": 100})
+
+	_, err = parseFormatLimits("GIF")
+	assert.NotNil(t, err)
+
+	_, err = parseFormatLimits("GIF=-1")
+	assert.NotNil(t, err)
+
+	_, err = parseFormatLimits("GFI=500")
+	assert.NotNil(t, err)
+}
+
+func TestEnabledOperations(t *testing.T) {
+	enabledOperations = map[string]bool{"s": true, "fm": true}
+	defer func() { enabledOperations = nil }()
+
+	assert.Nil(t, isSize("watermelon.jpg=s100x100", "JPEG", 74, 100))
+	assert.Nil(t, isSize("watermelon.jpg=fmpng", "PNG", 398, 536))
+
+	// Anything else is refused, however it's asked for.
+	assert.Equal(t, status("watermelon.jpg=c100x100"), http.StatusBadRequest)
+	assert.Equal(t, status("watermelon.jpg=ps100x100"), http.StatusBadRequest)
+	assert.Equal(t, status("watermelon.jpg=s100x100,blur=2"), http.StatusBadRequest)
+	assert.Equal(t, status("watermelon.jpg?w=100&h=100&op=crop"), http.StatusBadRequest)
+	assert.Equal(t, status("watermelon.jpg?w=100&h=100&preview=1"), http.StatusBadRequest)
+
+	list, err := parseOperationList("s,d,blur")
+	assert.Nil(t, err)
+	assert.Equal(t, list, map[string]bool{"s": true, "d": true, "blur": true})
+	list, err = parseOperationList("")
+	assert.Nil(t, err)
+	assert.Nil(t, list)
+	_, err = parseOperationList("s,rotate")
+	assert.NotNil(t, err)
+}
+
+func TestParseFormatSwitches(t *testing.T) {
+	switches, err := parseFormatSwitches("png=false,GIF=0,JPEG=true")
+	assert.Nil(t, err)
+	assert.Equal(t, switches, map[string]bool{"PNG": false, "GIF": false, "JPEG": true})
+
+	_, err = parseFormatSwitches("PNG")
+	assert.NotNil(t, err)
+
+	_, err = parseFormatSwitches("PNG=maybe")
+	assert.NotNil(t, err)
+
+	_, err = parseFormatSwitches("PGN=false")
+	assert.NotNil(t, err)
+}
+
+func TestParseStillFrame(t *testing.T) {
+	strategy, index, err := parseStillFrame("first")
+	assert.Nil(t, err)
+	assert.Equal(t, strategy, imager.StillFirst)
+
+	strategy, index, err = parseStillFrame("best")
+	assert.Nil(t, err)
+	assert.Equal(t, strategy, imager.StillBest)
+
+	strategy, index, err = parseStillFrame("2")
+	assert.Nil(t, err)
+	assert.Equal(t, strategy, imager.StillIndex)
+	assert.Equal(t, index, uint(2))
+
+	_, _, err = parseStillFrame("-1")
+	assert.NotNil(t, err)
+	_, _, err = parseStillFrame("last")
+	assert.NotNil(t, err)
+}
+
+func TestParseQualityCurve(t *testing.T) {
+	curve, err := parseQualityCurve("10000=70,1000000=85")
+	assert.Nil(t, err)
+	assert.Equal(t, curve, []imager.QualityPoint{{Pixels: 10000, Quality: 70}, {Pixels: 1000000, Quality: 85}})
+
+	curve, err = parseQualityCurve("")
+	assert.Nil(t, err)
+	assert.Nil(t, curve)
+
+	for _, bad := range []string{"10000", "0=70", "10000=0", "10000=101", "10000=70,5000=85", "10000=70,10000=85"} {
+		_, err = parseQualityCurve(bad)
+		assert.NotNil(t, err, bad)
+	}
+}
+
+func TestParseDefines(t *testing.T) {
+	defines, err := parseDefines("png:compression-level=9,webp:method=6")
+	assert.Nil(t, err)
+	assert.Equal(t, defines, map[string]string{"png:compression-level": "9", "webp:method": "6"})
+
+	_, err = parseDefines("png:compression-level")
+	assert.NotNil(t, err)
+
+	// Only allowlisted options may be set.
+	_, err = parseDefines("temporary-path=/etc")
+	assert.NotNil(t, err)
 }
 
 func isSize(filename, format string, width, height uint) error {
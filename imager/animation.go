@@ -0,0 +1,149 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package imager
+
+import (
+	"github.com/gographics/imagick/imagick"
+)
+
+// Output formats that can hold more than one frame.
+var animatedFormats = map[string]bool{
+	"GIF":  true,
+	"WEBP": true,
+}
+
+// canAnimate reports whether an animation can be saved in format: one of
+// animatedFormats, or PNG, as APNG, if ImageMagick can encode that.  APNG
+// has full alpha, which GIF lacks, for stickers and the like.
+func canAnimate(format string) bool {
+	return animatedFormats[format] || (format == "PNG" && CanEncode("APNG"))
+}
+
+// coalesce turns an animation's frames into complete images, so each can be
+// processed independently, after enforcing the output format's frame limit.
+func (result *Result) coalesce() error {
+	if max := result.img.MaxFrames[result.format]; max > 0 && result.wand.GetNumberImages() > max {
+		if !result.img.TruncateFrames {
+			return TooManyFrames
+		}
+
+		// Later frames only depend on earlier ones, so drop from the end.
+		for n := result.wand.GetNumberImages(); n > max; n-- {
+			result.wand.SetIteratorIndex(int(n - 1))
+			if err := result.wand.RemoveImage(); err != nil {
+				return err
+			}
+		}
+	}
+
+	coalesced := result.wand.CoalesceImages()
+	result.wand.Destroy()
+	result.wand = coalesced
+	result.animated = true
+
+	return nil
+}
+
+// each calls fn once for a still, or with each frame in turn as the current
+// image for an animation.
+func (result *Result) each(fn func() error) error {
+	if !result.animated {
+		return fn()
+	}
+
+	for result.wand.ResetIterator(); result.wand.NextImage(); {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// still reduces an animation to the one frame img.StillFrame chooses.
+func (result *Result) still() error {
+	n := result.wand.GetNumberImages()
+	if n <= 1 || result.img.StillFrame == StillFirst {
+		return nil
+	}
+
+	// Later frames may only hold what changed since earlier ones.
+	coalesced := result.wand.CoalesceImages()
+	result.wand.Destroy()
+	result.wand = coalesced
+
+	index := n - 1
+	switch result.img.StillFrame {
+	case StillIndex:
+		if result.img.FrameIndex < index {
+			index = result.img.FrameIndex
+		}
+	case StillBest:
+		best, err := result.bestFrame()
+		if err != nil {
+			return err
+		}
+		index = best
+	}
+
+	result.wand.SetIteratorIndex(int(index))
+	frame := result.wand.GetImage()
+	result.wand.Destroy()
+	result.wand = frame
+
+	return nil
+}
+
+// bestFrame returns the index of the sharpest coalesced frame, of at most
+// img.MaxScoredFrames spread evenly across the animation.
+func (result *Result) bestFrame() (uint, error) {
+	frames := result.wand.GetNumberImages()
+	scored := frames
+	if max := result.img.MaxScoredFrames; max > 0 && scored > max {
+		scored = max
+	}
+
+	best, bestScore := uint(0), -1.0
+	for n := uint(0); n < scored; n++ {
+		i := n * frames / scored
+		score, err := result.sharpness(i)
+		if err != nil {
+			return 0, err
+		}
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+
+	return best, nil
+}
+
+// Longest edge frames are scored at, which is plenty to tell sharp from
+// soft, and quick.
+const scoreSize = 128
+
+// sharpness scores frame i by the standard deviation of its edges.  Blank
+// and faded frames have few edges, and those blurred by motion or a
+// crossfade have soft ones, so the frame that best shows the clip scores
+// highest.
+func (result *Result) sharpness(i uint) (float64, error) {
+	result.wand.SetIteratorIndex(int(i))
+	frame := result.wand.GetImage()
+	defer frame.Destroy()
+
+	if width, height := frame.GetImageWidth(), frame.GetImageHeight(); width > scoreSize || height > scoreSize {
+		width, height = scaleAspect(width, height, scoreSize, scoreSize, true)
+		if err := frame.ResizeImage(width, height, imagick.FILTER_TRIANGLE, 1); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := frame.EdgeImage(1); err != nil {
+		return 0, err
+	}
+
+	_, deviation, err := frame.GetImageChannelMean(imagick.CHANNELS_ALL)
+	return deviation, err
+}
@@ -0,0 +1,104 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package imager
+
+import (
+	"github.com/gographics/imagick/imagick"
+)
+
+// AutoCrop crops away a matte around the image's content: the rows and
+// columns at its edges matching the top left pixel to within fuzz, a
+// fraction of full scale like 0.1, so JPEG noise in the matte is ignored.
+// If aspectWidth and aspectHeight are set, the content is then centered on
+// as little of the matte as makes that aspect ratio, so inconsistently
+// framed product photos come out alike.  An image that is all matte isn't
+// cropped.
+func (result *Result) AutoCrop(fuzz float64, aspectWidth, aspectHeight uint) error {
+	matte, err := result.trimMatte(fuzz)
+	if err != nil {
+		return err
+	}
+	defer matte.Destroy()
+
+	if aspectWidth == 0 || aspectHeight == 0 {
+		return nil
+	}
+
+	// Smallest size with the target aspect ratio around the content.
+	width, height := scaleAspect(aspectWidth, aspectHeight, result.Width, result.Height, false)
+	return result.pad(width, height, matte)
+}
+
+// trimMatte crops away the matte for AutoCrop, returning its color.
+func (result *Result) trimMatte(fuzz float64) (*imagick.PixelWand, error) {
+	// Find the content in what the viewer sees.
+	if err := result.Orientation.Fix(result.wand); err != nil {
+		return nil, err
+	}
+
+	matte, err := result.wand.GetImagePixelColor(0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// Find the content's bounds in the first frame, so every frame of an
+	// animation is cropped alike.
+	frame := result.wand.GetImage()
+	defer frame.Destroy()
+
+	_, quantumRange := imagick.GetQuantumRange()
+	if err := frame.TrimImage(fuzz * float64(quantumRange)); err != nil {
+		matte.Destroy()
+		return nil, err
+	}
+	_, _, x, y, err := frame.GetImagePage()
+	if err != nil {
+		matte.Destroy()
+		return nil, err
+	}
+
+	// ImageMagick leaves a single pixel when it finds nothing but matte.
+	width, height := frame.GetImageWidth(), frame.GetImageHeight()
+	if (width <= 1 && height <= 1) || (width >= result.Width && height >= result.Height) {
+		return matte, nil
+	}
+
+	if err := result.each(func() error { return result.cropFrame(width, height, x, y) }); err != nil {
+		matte.Destroy()
+		return nil, err
+	}
+
+	result.Cropped = &Region{X: x, Y: y, Width: width, Height: height}
+	result.Width = width
+	result.Height = height
+	result.transformed = true
+
+	return matte, nil
+}
+
+// pad centers the image on a width x height background of color, if that's
+// larger.
+func (result *Result) pad(width, height uint, color *imagick.PixelWand) error {
+	if width <= result.Width && height <= result.Height {
+		return nil
+	}
+
+	x, y := GravityCenter.offset(width, height, result.Width, result.Height)
+	err := result.each(func() error {
+		if err := result.wand.SetImageBackgroundColor(color); err != nil {
+			return err
+		}
+		return result.wand.ExtentImage(width, height, -x, -y)
+	})
+	if err != nil {
+		return err
+	}
+
+	result.Width = width
+	result.Height = height
+	result.transformed = true
+
+	return nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package imager
+
+// A Variant is one output of Batch: a chain of operations and the format to
+// save the result in.
+type Variant struct {
+	Operations []Operation
+	Format     string // "" = img.OutputFormat.
+}
+
+// Batch decodes the image once and produces an output for each variant,
+// in the same order.  Each variant works on its own copy of the decoded
+// image, so they don't affect each other.
+func (img *Imager) Batch(variants []Variant) ([][]byte, error) {
+	// Pre-scale no further than the largest variant needs.
+	var width, height uint
+	for i, v := range variants {
+		if len(v.Operations) == 0 {
+			// Full size is needed.
+			width, height = 0, 0
+			break
+		}
+
+		w, h := v.Operations[0].scaled(img.Width, img.Height)
+		if i == 0 || w > width {
+			width = w
+		}
+		if i == 0 || h > height {
+			height = h
+		}
+	}
+
+	base, err := img.NewResult(width, height)
+	if err != nil {
+		return nil, err
+	}
+	defer base.Close()
+
+	blobs := make([][]byte, 0, len(variants))
+	for _, v := range variants {
+		blob, err := base.variant(v)
+		if err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, blob)
+	}
+
+	return blobs, nil
+}
+
+func (base *Result) variant(v Variant) ([]byte, error) {
+	// Get() and most operations modify the wand in place.
+	result := base.Clone()
+	defer result.Close()
+
+	if v.Format != "" {
+		result.format = v.Format
+	}
+
+	for _, op := range v.Operations {
+		if err := result.Apply(op); err != nil {
+			return nil, err
+		}
+	}
+
+	return result.Get()
+}
@@ -0,0 +1,47 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package imager
+
+import (
+	"github.com/gographics/imagick/imagick"
+)
+
+// border frames the upright, finished image with img.BorderWidth pixels of
+// img.BorderColor on every side.  The frame adds to the size, unless
+// img.BorderInside, when the image is shrunk to fit within it instead, so
+// the output stays the size operations asked for.  Images too small to
+// hold a frame inside are left unframed.
+func (result *Result) border() error {
+	b := result.img.BorderWidth
+	if b == 0 {
+		return nil
+	}
+
+	color := imagick.NewPixelWand()
+	defer color.Destroy()
+	if !color.SetColor(result.img.BorderColor) {
+		return BadColor
+	}
+
+	// A colored frame needs color channels to go in.
+	if err := result.promote(); err != nil {
+		return err
+	}
+
+	width, height := result.Width+2*b, result.Height+2*b
+	if result.img.BorderInside {
+		if result.Width <= 2*b || result.Height <= 2*b {
+			return nil
+		}
+		width, height = result.Width, result.Height
+
+		w, h := scaleAspect(result.Width, result.Height, width-2*b, height-2*b, true)
+		if err := result.Resize(w, h); err != nil {
+			return err
+		}
+	}
+
+	return result.pad(width, height, color)
+}
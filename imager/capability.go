@@ -0,0 +1,111 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package imager
+
+import (
+	"github.com/gographics/imagick/imagick"
+	"sort"
+	"sync"
+)
+
+// Output formats worth probing for.  Which of them work depends on the
+// delegate libraries ImageMagick was built with.
+var probedFormats = []string{"APNG", "AVIF", "BMP", "GIF", "JPEG", "PNG", "WEBP"}
+
+// Input formats New accepts, as recognized by detectFormats.
+var inputFormats = map[string]bool{
+	"BMP":  true,
+	"GIF":  true,
+	"JPEG": true,
+	"PNG":  true,
+	"WEBP": true,
+}
+
+var (
+	probeOnce sync.Once
+	encodable map[string]bool
+	decodable map[string]bool
+)
+
+// CanEncode reports whether the linked ImageMagick can save in format,
+// as found by encoding a tiny image in each of the formats we might use,
+// once.  A format missing its library would otherwise only fail then.
+func CanEncode(format string) bool {
+	probeOnce.Do(probe)
+	return encodable[format]
+}
+
+// CanDecode reports whether New can load format: whether it is one we
+// accept, and the linked ImageMagick can read back what it encodes.
+func CanDecode(format string) bool {
+	probeOnce.Do(probe)
+	return decodable[format]
+}
+
+// Formats lists the formats that CanEncode and CanDecode allow, sorted.
+func Formats() (encode []string, decode []string) {
+	probeOnce.Do(probe)
+	return sortedKeys(encodable), sortedKeys(decodable)
+}
+
+// Version describes the linked ImageMagick, like "ImageMagick 6.9.10-23 Q16".
+func Version() string {
+	version, _ := imagick.GetVersion()
+	return version
+}
+
+func probe() {
+	encodable = map[string]bool{}
+	decodable = map[string]bool{}
+	for _, format := range probedFormats {
+		blob := encodeProbe(format)
+		if blob == nil {
+			continue
+		}
+		encodable[format] = true
+
+		if inputFormats[format] && decodeProbe(blob, format) {
+			decodable[format] = true
+		}
+	}
+}
+
+// encodeProbe returns a tiny image in format, or nil if it can't be saved.
+func encodeProbe(format string) []byte {
+	wand := imagick.NewMagickWand()
+	defer wand.Destroy()
+
+	if err := wand.NewImage(minDimension, minDimension, white); err != nil {
+		return nil
+	}
+	if err := wand.SetImageFormat(format); err != nil {
+		return nil
+	}
+
+	blob := wand.GetImageBlob()
+	if len(blob) == 0 {
+		return nil
+	}
+	return blob
+}
+
+func decodeProbe(blob []byte, format string) bool {
+	wand := imagick.NewMagickWand()
+	defer wand.Destroy()
+
+	if err := wand.SetFormat(format); err != nil {
+		return false
+	}
+	return wand.ReadImageBlob(blob) == nil && wand.GetImageWidth() == minDimension
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
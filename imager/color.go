@@ -0,0 +1,90 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package imager
+
+import (
+	"fmt"
+	"github.com/gographics/imagick/imagick"
+	"sort"
+)
+
+// Colors a sample is reduced to before picking the most common.
+const dominantColors = 8
+
+// DominantColor returns the most common color in the result, like
+// "#a0b1c2" or "transparent", as a backdrop to show until the image loads.
+func (result *Result) DominantColor() (string, error) {
+	palette, err := result.Palette(1)
+	if err != nil {
+		return "", err
+	}
+
+	// As CSS would say it.
+	if len(palette) == 0 {
+		return "transparent", nil
+	}
+	return palette[0], nil
+}
+
+// Palette returns up to n of the result's most common colors, most common
+// first, like "#a0b1c2", for theming around it.  Transparent colors are
+// left out.  It quantizes a sample of the current frame, ColorSampleSize on
+// a side, so it's cheap even for large images, or if that's 0, every pixel.
+func (result *Result) Palette(n uint) ([]string, error) {
+	wand := result.wand.GetImage()
+	defer wand.Destroy()
+
+	if size := result.img.ColorSampleSize; size > 0 {
+		if err := wand.ResizeImage(size, size, imagick.FILTER_BOX, 1); err != nil {
+			return nil, err
+		}
+	}
+
+	colors := n
+	if colors < dominantColors {
+		colors = dominantColors
+	}
+	if err := wand.QuantizeImage(colors, imagick.COLORSPACE_SRGB, 0, false, false); err != nil {
+		return nil, err
+	}
+
+	_, histogram := wand.GetImageHistogram()
+	defer func() {
+		for _, color := range histogram {
+			color.Destroy()
+		}
+	}()
+
+	// Transparent pixels show whatever is behind them, so don't count.
+	opaque := make([]*imagick.PixelWand, 0, len(histogram))
+	for _, color := range histogram {
+		if color.GetAlpha() >= 0.5 {
+			opaque = append(opaque, color)
+		}
+	}
+	sort.Stable(byCount(opaque))
+
+	palette := []string{}
+	for _, color := range opaque {
+		if uint(len(palette)) == n {
+			break
+		}
+		palette = append(palette, fmt.Sprintf("#%02x%02x%02x", channel(color.GetRed()), channel(color.GetGreen()), channel(color.GetBlue())))
+	}
+
+	return palette, nil
+}
+
+// byCount sorts histogram colors most common first.
+type byCount []*imagick.PixelWand
+
+func (c byCount) Len() int           { return len(c) }
+func (c byCount) Less(i, j int) bool { return c[i].GetColorCount() > c[j].GetColorCount() }
+func (c byCount) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// channel scales a 0-1 color channel to 0-255.
+func channel(value float64) uint8 {
+	return uint8(value*255 + 0.5)
+}
@@ -0,0 +1,93 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package imager
+
+import (
+	"github.com/gographics/imagick/imagick"
+)
+
+// BlendMode selects how Composite combines an overlay with the image under it.
+type BlendMode int
+
+const (
+	BlendOver     BlendMode = iota // Paint the overlay over the image.
+	BlendMultiply                  // Darken the image by the overlay.
+	BlendScreen                    // Lighten the image by the overlay.
+)
+
+var blendOperators = map[BlendMode]imagick.CompositeOperator{
+	BlendOver:     imagick.COMPOSITE_OP_OVER,
+	BlendMultiply: imagick.COMPOSITE_OP_MULTIPLY,
+	BlendScreen:   imagick.COMPOSITE_OP_SCREEN,
+}
+
+// Composite places the overlay image, like a badge or ribbon, against the
+// side or corner of the result selected by gravity, offset inward by x and
+// y pixels.  Its opacity is scaled by opacity, from 0 to 1.  The overlay is
+// held to the same format and size limits as the image passed to New.
+func (result *Result) Composite(overlay []byte, gravity Gravity, x, y int, opacity float64, mode BlendMode) error {
+	operator, ok := blendOperators[mode]
+	if !ok {
+		return UnknownBlendMode
+	}
+
+	img, err := New(overlay, result.img.maxBufferPixels)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	// Security: Overlays are decoded at full size, so can't count on the
+	// JPEG pre-scaling New allows for.
+	if uint64(img.Width)*uint64(img.Height) > uint64(result.img.maxBufferPixels) {
+		return TooBig
+	}
+
+	over, err := img.NewResult(0, 0)
+	if err != nil {
+		return err
+	}
+	defer over.Close()
+
+	// Position against what the viewer sees, not the stored pixels.
+	if err := over.Orientation.Fix(over.wand); err != nil {
+		return err
+	}
+	if err := result.Orientation.Fix(result.wand); err != nil {
+		return err
+	}
+
+	// A color overlay needs color channels to go in.
+	if !over.gray {
+		if err := result.promote(); err != nil {
+			return err
+		}
+	}
+
+	if opacity < 1 {
+		if err := over.wand.SetImageAlphaChannel(imagick.ALPHA_CHANNEL_SET); err != nil {
+			return err
+		}
+		if err := over.wand.EvaluateImageChannel(imagick.CHANNEL_ALPHA, imagick.EVALUATE_MULTIPLY, opacity); err != nil {
+			return err
+		}
+	}
+
+	ox, oy := gravity.offset(result.Width, result.Height, over.Width, over.Height)
+	switch gravity {
+	case GravityNorthEast, GravityEast, GravitySouthEast:
+		ox -= x
+	default:
+		ox += x
+	}
+	switch gravity {
+	case GravitySouthWest, GravitySouth, GravitySouthEast:
+		oy -= y
+	default:
+		oy += y
+	}
+
+	return result.each(func() error { return result.wand.CompositeImage(over.wand, operator, ox, oy) })
+}
@@ -0,0 +1,82 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package imager
+
+import (
+	"github.com/gographics/imagick/imagick"
+)
+
+// How many times New's pixel limit the frames of a contact sheet may
+// decode to, all told, as each is expanded to the full canvas.
+const contactSheetBuffers = 4
+
+// ContactSheet lays out every frame of an animation, complete rather than
+// just what changed, left to right and top to bottom in a grid columns
+// wide, or in one row if columns is 0.  Each is scaled to fit within width
+// x height, and the sheet is saved as one still on img.BackgroundColor.
+// Fails with TooBig if the sheet would have more pixels than New allowed,
+// or its frames more than contactSheetBuffers times that.
+func (img *Imager) ContactSheet(columns, width, height uint) ([]byte, error) {
+	// Security: Many tiny frames of a large canvas would each decode to
+	// all of it, so refuse before decoding any.
+	if uint64(img.Width)*uint64(img.Height)*uint64(img.Frames) > contactSheetBuffers*uint64(img.maxBufferPixels) {
+		return nil, TooBig
+	}
+
+	result, err := img.newResult(width, height, true)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	// Only stills have EXIF orientation to fix.
+	if err := result.Orientation.Fix(result.wand); err != nil {
+		return nil, err
+	}
+
+	width, height = scaleAspect(result.Width, result.Height, width, height, true)
+	if err := result.Resize(width, height); err != nil {
+		return nil, err
+	}
+
+	frames := result.wand.GetNumberImages()
+	if columns == 0 || columns > frames {
+		columns = frames
+	}
+	rows := (frames + columns - 1) / columns
+	if uint64(columns*width)*uint64(rows*height) > uint64(img.maxBufferPixels) {
+		return nil, TooBig
+	}
+
+	background := imagick.NewPixelWand()
+	defer background.Destroy()
+	if !background.SetColor(img.BackgroundColor) {
+		return nil, BadColor
+	}
+
+	sheet := imagick.NewMagickWand()
+	if err := sheet.NewImage(columns*width, rows*height, background); err != nil {
+		sheet.Destroy()
+		return nil, err
+	}
+
+	for i := uint(0); i < frames; i++ {
+		result.wand.SetIteratorIndex(int(i))
+		x, y := (i%columns)*width, (i/columns)*height
+		if err := sheet.CompositeImage(result.wand, imagick.COMPOSITE_OP_OVER, int(x), int(y)); err != nil {
+			sheet.Destroy()
+			return nil, err
+		}
+	}
+
+	result.wand.Destroy()
+	result.wand = sheet
+	result.animated = false
+	result.gray = false
+	result.Width = columns * width
+	result.Height = rows * height
+
+	return result.Get()
+}
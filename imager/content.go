@@ -0,0 +1,90 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package imager
+
+import (
+	"fmt"
+	"github.com/gographics/imagick/imagick"
+)
+
+// ContentClass is a guess at what an image depicts, for choosing a format.
+type ContentClass int
+
+const (
+	ContentPhoto   ContentClass = iota // Continuous tone; suits lossy formats.
+	ContentGraphic                     // Flat color, hard edges, or transparency; suits lossless formats.
+)
+
+// Width and height of the sample that Classify inspects.
+const classifySample = 64
+
+// Classify guesses whether the image is a photo or a graphic, from a small
+// sample of its pixels, using the Graphic* thresholds.
+func (img *Imager) Classify() (ContentClass, error) {
+	wand := imagick.NewMagickWand()
+	defer wand.Destroy()
+
+	// Let the JPEG decoder pre-scale; we don't need detail.
+	width, height := scaleAspect(img.Width, img.Height, classifySample, classifySample, true)
+	if err := wand.SetOption("jpeg:size", fmt.Sprintf("%dx%d", width, height)); err != nil {
+		return ContentPhoto, err
+	}
+	if err := wand.SetFormat(img.InputFormat); err != nil {
+		return ContentPhoto, err
+	}
+	if err := wand.ReadImageBlob(img.blob); err != nil {
+		return ContentPhoto, err
+	}
+	wand.ResetIterator()
+
+	// Photos rarely have transparency.
+	if wand.GetImageAlphaChannel() {
+		return ContentGraphic, nil
+	}
+
+	// Point-sample, so flat areas stay flat rather than being blended.
+	if err := wand.SampleImage(width, height); err != nil {
+		return ContentPhoto, err
+	}
+
+	// Graphics use relatively few distinct colors.
+	if float64(wand.GetImageColors()) < img.GraphicColorRatio*float64(width*height) {
+		return ContentGraphic, nil
+	}
+
+	// And have large areas of exactly the same color bounded by hard
+	// edges, where photos have noise and gradients.
+	pixels, err := wand.ExportImagePixels(0, 0, width, height, "RGB", imagick.PIXEL_CHAR)
+	if err != nil {
+		return ContentPhoto, err
+	}
+	if rgb, ok := pixels.([]byte); ok && flatFraction(rgb, int(width)) >= img.GraphicFlatFraction {
+		return ContentGraphic, nil
+	}
+
+	return ContentPhoto, nil
+}
+
+// flatFraction returns the fraction of horizontally adjacent pixels in an RGB
+// buffer of the given width that are exactly the same color.
+func flatFraction(rgb []byte, width int) float64 {
+	pairs, flat := 0, 0
+	for i := 0; i+6 <= len(rgb); i += 3 {
+		// Don't compare the last pixel of a row with the first of the next.
+		if (i/3)%width == width-1 {
+			continue
+		}
+
+		pairs++
+		if rgb[i] == rgb[i+3] && rgb[i+1] == rgb[i+4] && rgb[i+2] == rgb[i+5] {
+			flat++
+		}
+	}
+
+	if pairs == 0 {
+		return 0
+	}
+	return float64(flat) / float64(pairs)
+}
@@ -0,0 +1,42 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package imager
+
+// AllowedDefines lists the coder options that Imager.Defines may set.  They
+// only tune how output is compressed; options that could read or write
+// files, or enable other coders, are deliberately absent.
+var AllowedDefines = map[string]bool{
+	"jpeg:dct-method":          true,
+	"jpeg:optimize-coding":     true,
+	"jpeg:sampling-factor":     true,
+	"png:compression-filter":   true,
+	"png:compression-level":    true,
+	"png:compression-strategy": true,
+	"png:exclude-chunk":        true,
+	"webp:alpha-quality":       true,
+	"webp:exact":               true,
+	"webp:filter-strength":     true,
+	"webp:image-hint":          true,
+	"webp:lossless":            true,
+	"webp:method":              true,
+	"webp:near-lossless":       true,
+	"webp:sns-strength":        true,
+}
+
+// applyDefines sets img.Defines on the wand, after our own options so
+// they can be overridden, refusing any not in AllowedDefines.
+func (result *Result) applyDefines() error {
+	for key, value := range result.img.Defines {
+		if !AllowedDefines[key] {
+			return ForbiddenDefine
+		}
+
+		if err := result.wand.SetOption(key, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
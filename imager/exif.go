@@ -0,0 +1,176 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package imager
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	tagJpegInterchangeFormat       = 0x0201 // Offset of IFD1's thumbnail.
+	tagJpegInterchangeFormatLength = 0x0202 // Length of IFD1's thumbnail.
+)
+
+// ExifThumbnail returns the thumbnail embedded in a JPEG's EXIF data, without
+// decoding the image.  If there isn't one, it falls back to
+// Thumbnail(width, height, true).  Embedded thumbnails are usually around
+// 160x120, and aren't corrected for orientation or color profile.
+func (img *Imager) ExifThumbnail(width, height uint) ([]byte, error) {
+	if img.InputFormat == "JPEG" {
+		if thumb := exifThumbnail(img.blob); thumb != nil {
+			// Copy, so we don't pin the whole original in memory.
+			return append([]byte(nil), thumb...), nil
+		}
+	}
+
+	return img.Thumbnail(width, height, true)
+}
+
+// exifThumbnail returns the JPEG referenced by IFD1 of blob's EXIF data, or nil.
+func exifThumbnail(blob []byte) []byte {
+	tiff := jpegSegment(blob, 0xe1, []byte("Exif\x00\x00"))
+	order := tiffByteOrder(tiff)
+	if order == nil {
+		return nil
+	}
+
+	ifd1 := ifdNext(tiff, order, order.Uint32(tiff[4:]))
+	if ifd1 == 0 {
+		return nil
+	}
+
+	offset := uint64(ifdTag(tiff, order, ifd1, tagJpegInterchangeFormat))
+	length := uint64(ifdTag(tiff, order, ifd1, tagJpegInterchangeFormatLength))
+	if offset == 0 || length == 0 || offset+length > uint64(len(tiff)) {
+		return nil
+	}
+
+	// Make sure it at least starts like a JPEG.
+	thumb := tiff[offset : offset+length]
+	if !bytes.HasPrefix(thumb, []byte{0xff, 0xd8}) {
+		return nil
+	}
+
+	return thumb
+}
+
+// jpegSegment returns the payload of the first marker segment of blob that
+// starts with prefix, minus that prefix, or nil.
+func jpegSegment(blob []byte, marker byte, prefix []byte) []byte {
+	offset := jpegSegmentOffset(blob, marker, prefix)
+	if offset < 0 {
+		return nil
+	}
+
+	n := int(blob[offset-len(prefix)-2])<<8 | int(blob[offset-len(prefix)-1])
+	return blob[offset : offset-len(prefix)-2+n]
+}
+
+// jpegSegmentOffset is jpegSegment, but returns where in blob the payload
+// starts, or -1.
+func jpegSegmentOffset(blob []byte, marker byte, prefix []byte) int {
+	if !bytes.HasPrefix(blob, []byte{0xff, 0xd8}) {
+		return -1
+	}
+
+	for i := 2; i+4 <= len(blob); {
+		if blob[i] != 0xff {
+			return -1
+		}
+
+		m := blob[i+1]
+		if m == 0xff {
+			i++ // Fill byte.
+			continue
+		}
+		if m == 0xda || m == 0xd9 {
+			return -1 // Start of scan or end of image; no more metadata.
+		}
+
+		n := int(blob[i+2])<<8 | int(blob[i+3])
+		if n < 2 || i+2+n > len(blob) {
+			return -1
+		}
+
+		if m == marker && bytes.HasPrefix(blob[i+4:i+2+n], prefix) {
+			return i + 4 + len(prefix)
+		}
+
+		i += 2 + n
+	}
+
+	return -1
+}
+
+// tiffByteOrder validates a TIFF header and returns its byte order, or nil.
+func tiffByteOrder(tiff []byte) binary.ByteOrder {
+	if len(tiff) < 8 {
+		return nil
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil
+	}
+
+	if order.Uint16(tiff[2:]) != 42 {
+		return nil
+	}
+
+	return order
+}
+
+// ifdEntries returns the 12-byte entries of the IFD at offset, or nil.
+func ifdEntries(tiff []byte, order binary.ByteOrder, offset uint32) []byte {
+	if offset < 8 || uint64(offset)+2 > uint64(len(tiff)) {
+		return nil
+	}
+
+	end := uint64(offset) + 2 + 12*uint64(order.Uint16(tiff[offset:]))
+	if end+4 > uint64(len(tiff)) {
+		return nil
+	}
+
+	return tiff[offset+2 : end]
+}
+
+// ifdNext returns the offset of the IFD following the one at offset, or 0.
+func ifdNext(tiff []byte, order binary.ByteOrder, offset uint32) uint32 {
+	entries := ifdEntries(tiff, order, offset)
+	if entries == nil {
+		return 0
+	}
+
+	end := int(offset) + 2 + len(entries)
+	return order.Uint32(tiff[end:])
+}
+
+// ifdTag returns the value of a SHORT or LONG tag in the IFD at offset, or 0.
+func ifdTag(tiff []byte, order binary.ByteOrder, offset uint32, tag uint16) uint32 {
+	entries := ifdEntries(tiff, order, offset)
+
+	for i := 0; i+12 <= len(entries); i += 12 {
+		entry := entries[i : i+12]
+		if order.Uint16(entry) != tag {
+			continue
+		}
+
+		switch order.Uint16(entry[2:]) {
+		case 3: // SHORT
+			return uint32(order.Uint16(entry[8:]))
+		case 4: // LONG
+			return order.Uint32(entry[8:])
+		}
+		return 0
+	}
+
+	return 0
+}
@@ -0,0 +1,31 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package imager
+
+// fallbackFormat picks the format to save in.  The usual format stands
+// unless there are FallbackFormats and it can't represent the result: it
+// needs alpha the format lacks, or it is a still taken from an animation,
+// whose format was only chosen for animating.  Then the first fallback
+// that can hold the result wins, or the usual format if none can.
+func (result *Result) fallbackFormat() string {
+	if len(result.img.FallbackFormats) == 0 {
+		return result.format
+	}
+
+	alpha := result.wand.GetImageAlphaChannel()
+	still := result.img.Frames > 1 && !result.animated
+
+	if !still && (!alpha || alphaFormats[result.format]) {
+		return result.format
+	}
+
+	for _, format := range result.img.FallbackFormats {
+		if !alpha || alphaFormats[format] {
+			return format
+		}
+	}
+
+	return result.format
+}
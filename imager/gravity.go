@@ -0,0 +1,44 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package imager
+
+// Gravity selects which part of an area something is placed against.
+type Gravity int
+
+const (
+	GravityCenter    Gravity = iota // Centered in both dimensions.
+	GravityNorth                    // Centered along the top edge.
+	GravityNorthEast                // In the top right corner.
+	GravityEast                     // Centered along the right edge.
+	GravitySouthEast                // In the bottom right corner.
+	GravitySouth                    // Centered along the bottom edge.
+	GravitySouthWest                // In the bottom left corner.
+	GravityWest                     // Centered along the left edge.
+	GravityNorthWest                // In the top left corner.
+)
+
+// offset returns where to place an inner area within an outer one, such
+// that it's against the side or corner selected by gravity.
+func (gravity Gravity) offset(outerWidth, outerHeight, innerWidth, innerHeight uint) (int, int) {
+	// Round half pixels up, toward the bottom right.
+	x := (int(outerWidth) - int(innerWidth) + 1) / 2
+	y := (int(outerHeight) - int(innerHeight) + 1) / 2
+
+	switch gravity {
+	case GravityNorthWest, GravityWest, GravitySouthWest:
+		x = 0
+	case GravityNorthEast, GravityEast, GravitySouthEast:
+		x = int(outerWidth) - int(innerWidth)
+	}
+
+	switch gravity {
+	case GravityNorthWest, GravityNorth, GravityNorthEast:
+		y = 0
+	case GravitySouthWest, GravitySouth, GravitySouthEast:
+		y = int(outerHeight) - int(innerHeight)
+	}
+
+	return x, y
+}
@@ -9,8 +9,19 @@ import (
 )
 
 var (
-	UnknownFormat = errors.New("Unknown image format")
-	TooBig        = errors.New("Image is too wide or tall")
+	UnknownFormat    = errors.New("Unknown image format")
+	TooBig           = errors.New("Image is too wide or tall")
+	TooSmall         = errors.New("Image is too small to be useful")
+	Truncated        = errors.New("Image is truncated or corrupt")
+	WouldUpscale     = errors.New("Image is too small for the requested crop")
+	TooManyFrames    = errors.New("Animation has too many frames")
+	BadColor         = errors.New("Unrecognized color")
+	UnknownBlendMode = errors.New("Unknown blend mode")
+	ForbiddenDefine  = errors.New("Coder option is not allowed")
+	NoOutput         = errors.New("Encoder produced no output")
+	OverBudget       = errors.New("Image needs more memory than allowed")
+	AnimationTooBig  = errors.New("Animation has too many pixels across its frames")
+	BadProfile       = errors.New("Image has an unusable color profile")
 )
 
 const (
@@ -18,35 +29,169 @@ const (
 	maxDimension = (1 << 15) - 2 // Avoid signed int16 overflows.
 )
 
+// ContrastMode selects how AutoContrast stretches an image's contrast.
+type ContrastMode int
+
+const (
+	ContrastNormalize  ContrastMode = iota // Stretch all channels together.
+	ContrastPerChannel                     // Stretch red, green, and blue independently.
+	ContrastCLAHE                          // Contrast-limited adaptive histogram equalization.
+)
+
+// StillFrameStrategy selects which frame of an animation becomes a still.
+type StillFrameStrategy int
+
+const (
+	StillFirst StillFrameStrategy = iota // The first frame, which is often blank.
+	StillIndex                           // Frame FrameIndex, counting from 0, or the last if there are fewer.
+	StillBest                            // The sharpest frame, by its edges, of at most MaxScoredFrames.
+)
+
+// A QualityPoint is a JPEG quality to use at an output size, for
+// JpegQualityCurve.
+type QualityPoint struct {
+	Pixels  uint
+	Quality uint
+}
+
+// UpscalePolicy selects what a crop does when both target dimensions exceed the source.
+type UpscalePolicy int
+
+const (
+	UpscaleClamp  UpscalePolicy = iota // Crop to the target aspect ratio at the source's size.
+	UpscaleAllow                       // Enlarge to the target size, then crop.
+	UpscaleReject                      // Fail with WouldUpscale.
+)
+
+// ProfilePolicy selects what to do with an image whose embedded color
+// profile can't be applied, as it's malformed.
+type ProfilePolicy int
+
+const (
+	ProfileBestEffort ProfilePolicy = iota // Convert as if untagged, from AssumeProfile or AssumeCMYKProfile if set.
+	ProfileAssumeSRGB                      // Strip the profile, taking RGB pixels as sRGB whatever AssumeProfile says.
+	ProfileReject                          // Fail with BadProfile.
+)
+
 type Imager struct {
-	blob               []byte
-	Width              uint
-	Height             uint
-	Orientation        *Orientation
-	InputFormat        string
-	OutputFormat       string
-	JpegQuality        uint
-	PngMaxBitsPerPixel uint
-	Sharpen            bool
-	BlurFactor         float64
-	AutoContrast       bool
+	blob                 []byte
+	maxBufferPixels      uint // As passed to New, for decoding any other images.
+	downscaled           bool // Whether Width and Height were shrunk to fit maxBufferPixels.
+	fullWidth            uint // Width and Height as stored, before any downscaling.
+	fullHeight           uint
+	Width                uint
+	Height               uint
+	Frames               uint
+	Orientation          *Orientation
+	InputFormat          string
+	OutputFormat         string
+	FallbackFormats      []string // Preference order when OutputFormat can't hold the result; nil = OutputFormat regardless.
+	JpegQuality          uint
+	JpegQualityCurve     []QualityPoint // Quality by output pixels, smallest first, interpolated between; nil = JpegQuality.
+	Quality              uint           // Overrides the usual quality of any format but previews; 0 = usual.
+	Preview              bool           // Compress with PreviewQuality rather than the format's usual quality.
+	PreviewQuality       uint
+	Progressive          bool            // Interlace output; previews always are, so something shows fast.
+	ProgressiveMinPixels uint            // Save smaller output but previews non-interlaced, as interlacing costs more than it saves; 0 = no minimum.
+	Interlace            map[string]bool // Per-OutputFormat override of Progressive, like {"PNG": true}; missing = Progressive.
+	PngMaxBitsPerPixel   uint
+	Sharpen              bool
+	SharpenThreshold     float64 // Only sharpen when shrunk by more than this ratio, like 1.5; 0 = always.
+	SharpenCurve         float64 // Grow sharpening with the shrink ratio raised to this power, like 0.5; 0 = fixed.
+	SharpenMaxAmount     float64 // Most sharpening SharpenCurve may reach, as an unsharp mask amount.
+	LanczosThreshold     float64 // Resize with Lanczos when shrinking by more than this fraction, like 0.025, else Triangle; 0 = any shrink, negative = always.
+	TrimFuzz             float64 // How far from the matte's color, as a fraction of full scale, pixels OpTrim crops may be.
+	BlurFactor           float64
+	PixelArt             bool // Enlarge by whole multiples, without smoothing, so pixels stay crisp blocks.
+	BlurAfterResize      bool // Blur once resized rather than on decode; faster, with fewer pixels, but coarser.
+	AutoContrast         bool
+	AutoContrastMode     ContrastMode
+	AutoLevel            bool
+	AutoGamma            bool
+	JpegOptimizeCoding   bool    // Compute optimal Huffman tables; false leaves ImageMagick's default.
+	JpegDctMethod        string  // "islow", "ifast", "float", or "" for ImageMagick's default.
+	JpegRestartInterval  uint    // MCUs between restart markers, so a corrupt byte spoils less; 0 = none.
+	JpegRGB              bool    // Store RGB without the YCbCr transform or chroma subsampling, for exact color; overrides JpegKeepSampling.
+	JpegKeepSampling     bool    // Subsample chroma as a JPEG source did, rather than by quality.
+	Density              float64 // Output resolution in pixels per inch; 0 leaves it untouched.
+	BestEffort           bool    // Render whatever could be decoded from a truncated image.
+	MaxMemory            uint64  // Most bytes of decoded pixels one Result may hold, across frames; 0 = unlimited.
+	CropUpscale          UpscalePolicy
+	BrokenProfile        ProfilePolicy      // What to do when an embedded color profile can't be applied.
+	AnimatedOutput       bool               // Keep every frame of an animation, if OutputFormat allows it: GIF, WEBP, or PNG as APNG.
+	MaxFrames            map[string]uint    // Per-OutputFormat animation frame limit; missing = unlimited.
+	TruncateFrames       bool               // Drop frames past MaxFrames, rather than fail with TooManyFrames.
+	MaxAnimationPixels   uint64             // Most pixels an animation may decode to, summed across frames; 0 = unlimited.
+	StillFrame           StillFrameStrategy // Which frame to keep of an animation that isn't saved as one.
+	FrameIndex           uint               // The frame StillIndex keeps.
+	MaxScoredFrames      uint               // Most frames StillBest scores, spread evenly across the animation; 0 = all.
+	GraphicColorRatio    float64            // Classify as graphic below this many distinct colors per pixel.
+	GraphicFlatFraction  float64            // Classify as graphic when this fraction of neighboring pixels match.
+	GraphicFormat        string             // Save images Classify finds graphics in this format instead of OutputFormat; "" = OutputFormat regardless.
+	ColorSampleSize      uint               // Edge of the sample Palette and DominantColor quantize, like 16; 0 = every pixel.
+	KeepXMP              bool               // Preserve XMP metadata, which otherwise is stripped.
+	KeepGrayscale        bool               // Keep untagged grayscale input single-channel, unless color is added.
+	EmbedSRGB            bool               // Tag output with a compact sRGB profile, for color-managed viewers.
+	WideGamut            bool               // Keep wide-gamut input in Display P3, tagged as such, rather than clipping it to sRGB.
+	Defines              map[string]string  // Coder options to set before compressing, from AllowedDefines.
+	BackgroundColor      string             // Fill for areas exposed by Rotate, matte padding and contact sheets, like "white" or "none" for transparent; borders use BorderColor.
+	BorderWidth          uint               // Pixels of BorderColor framing the output on each side; 0 = none.
+	BorderColor          string             // Color of the frame, like "white".
+	BorderInside         bool               // Shrink the image within the frame, rather than growing the output by it.
+	AssumeProfile        []byte             // ICC profile of untagged RGB input, like Adobe RGB; nil = sRGB.
+	AssumeCMYKProfile    []byte             // ICC profile of untagged CMYK input, like SWOP; nil = uncalibrated.
+	UpscaleSharpen       bool               // Also lightly sharpen enlarged images, if Sharpen is set.
+	WebpAlphaQuality     uint               // Quality of the alpha channel of WEBP output; 100 = lossless.
+	WebpLossless         bool               // Save WEBP output losslessly, with bit-exact alpha.
 }
 
 func New(blob []byte, maxBufferPixels uint) (*Imager, error) {
-	// Security: Guess at formats.  Limit formats we pass to ImageMagick
-	// to just JPEG, PNG, GIF, BMP.
+	return newImager(blob, maxBufferPixels, false, minDimension)
+}
+
+// NewMinimum is like New, but only refuses images narrower or shorter than
+// minDimension, which may be 1, for uses like placeholders where even a
+// single pixel, scaled up, is of some use.
+func NewMinimum(blob []byte, maxBufferPixels, minDimension uint) (*Imager, error) {
+	if minDimension < 1 {
+		minDimension = 1
+	}
+	return newImager(blob, maxBufferPixels, false, minDimension)
+}
+
+// NewDownscaling is like New, but rather than refusing a JPEG too large
+// for maxBufferPixels, treats it as if it were downscaled by half, a
+// quarter or an eighth to fit, which the JPEG decoder's pre-scaling makes
+// cheap.  Other formats would need decoding at full size first, so are
+// still refused.
+func NewDownscaling(blob []byte, maxBufferPixels uint) (*Imager, error) {
+	return newImager(blob, maxBufferPixels, true, minDimension)
+}
+
+func newImager(blob []byte, maxBufferPixels uint, downscale bool, minSize uint) (*Imager, error) {
+	// Security: Guess at formats from content, never filenames.  Limit
+	// formats we pass to ImageMagick to just JPEG, PNG, GIF, BMP, WEBP, so
+	// SVG, MVG, MSL and friends are refused however they are labeled.
 	inputFormat, outputFormat := detectFormats(blob)
-	if inputFormat == "" {
+	if inputFormat == "" || !CanDecode(inputFormat) {
 		return nil, UnknownFormat
 	}
 
-	// Ask ImageMagick to parse metadata.
-	width, height, orientation, format, err := imageMetaData(blob)
+	// Decode the primary image of multi-picture JPEGs, not a preview.
+	if inputFormat == "JPEG" {
+		blob = mpfPrimary(blob)
+	}
+
+	// Ask ImageMagick to parse metadata. We already recognized the
+	// format, so failure here means the data itself is bad.
+	info, frames, orientation, err := imageMetaData(blob, inputFormat)
 	if err != nil {
-		return nil, UnknownFormat
+		return nil, Truncated
 	}
+	width, height, format := info.Width, info.Height, info.Format
 
 	// Assume JPEG decoder can pre-scale to 1/8 original size.
+	limit := maxBufferPixels
 	if format == "JPEG" {
 		maxBufferPixels *= 8
 	}
@@ -55,26 +200,102 @@ func New(blob []byte, maxBufferPixels uint) (*Imager, error) {
 	// format and that image sizes are sane.
 	if format != inputFormat {
 		return nil, UnknownFormat
-	} else if width < minDimension || height < minDimension {
-		return nil, UnknownFormat
+	} else if width < minSize || height < minSize {
+		return nil, TooSmall
 	} else if width > maxDimension || height > maxDimension {
 		return nil, TooBig
+	}
+
+	downscaled := false
+	fullWidth, fullHeight := width, height
+	if downscale && format == "JPEG" && width*height > limit {
+		// The decoder pre-scales by at most 1/8 per side.
+		if jpegScaled(width, 1)*jpegScaled(height, 1) > limit {
+			return nil, TooBig
+		}
+
+		// Only by halves though, so take the largest of those that fits,
+		// rather than exactly fitting, which it would decode larger.
+		eighths := uint(4)
+		for eighths > 1 && jpegScaled(width, eighths)*jpegScaled(height, eighths) > limit {
+			eighths /= 2
+		}
+		width, height = width*eighths/8, height*eighths/8
+		downscaled = true
 	} else if width*height > maxBufferPixels {
 		return nil, TooBig
 	}
 
 	img := &Imager{
-		blob:               blob,
-		Width:              width,
-		Height:             height,
-		Orientation:        orientation,
-		InputFormat:        inputFormat,
-		OutputFormat:       outputFormat,
-		JpegQuality:        85,
-		PngMaxBitsPerPixel: 4,
-		Sharpen:            true,
-		BlurFactor:         0.0,
-		AutoContrast:       false,
+		blob:                 blob,
+		maxBufferPixels:      limit,
+		downscaled:           downscaled,
+		fullWidth:            fullWidth,
+		fullHeight:           fullHeight,
+		Width:                width,
+		Height:               height,
+		Frames:               frames,
+		Orientation:          orientation,
+		InputFormat:          inputFormat,
+		OutputFormat:         outputFormat,
+		FallbackFormats:      nil,
+		JpegQuality:          85,
+		JpegQualityCurve:     nil,
+		Quality:              0,
+		Preview:              false,
+		PreviewQuality:       40,
+		Progressive:          true,
+		ProgressiveMinPixels: 10000,
+		Interlace:            map[string]bool{"PNG": false},
+		PngMaxBitsPerPixel:   4,
+		Sharpen:              true,
+		SharpenThreshold:     0.0,
+		SharpenCurve:         0.0,
+		SharpenMaxAmount:     2.0,
+		LanczosThreshold:     0.025,
+		TrimFuzz:             0.1,
+		BlurFactor:           0.0,
+		PixelArt:             false,
+		BlurAfterResize:      false,
+		AutoContrast:         false,
+		AutoContrastMode:     ContrastNormalize,
+		AutoLevel:            false,
+		AutoGamma:            false,
+		JpegOptimizeCoding:   false,
+		JpegDctMethod:        "",
+		JpegRestartInterval:  0,
+		JpegRGB:              false,
+		JpegKeepSampling:     false,
+		Density:              0.0,
+		BestEffort:           false,
+		MaxMemory:            0,
+		CropUpscale:          UpscaleClamp,
+		BrokenProfile:        ProfileBestEffort,
+		AnimatedOutput:       false,
+		MaxFrames:            nil,
+		TruncateFrames:       true,
+		MaxAnimationPixels:   0,
+		StillFrame:           StillFirst,
+		FrameIndex:           0,
+		MaxScoredFrames:      20,
+		GraphicColorRatio:    0.05,
+		GraphicFlatFraction:  0.9,
+		GraphicFormat:        "",
+		ColorSampleSize:      16,
+		KeepXMP:              false,
+		KeepGrayscale:        true,
+		EmbedSRGB:            false,
+		WideGamut:            false,
+		Defines:              nil,
+		BackgroundColor:      "white",
+		BorderWidth:          0,
+		BorderColor:          "white",
+		BorderInside:         false,
+		AssumeProfile:        nil,
+		AssumeCMYKProfile:    nil,
+		UpscaleSharpen:       false,
+		WebpAlphaQuality:     100,
+		WebpLossless:         false,
 	}
 
 	return img, nil
@@ -97,29 +318,47 @@ func (img *Imager) Thumbnail(width, height uint, within bool) ([]byte, error) {
 }
 
 func (img *Imager) Crop(width, height uint) ([]byte, error) {
-	// Figure out the intermediate size the original image would have to
-	// be scaled to be cropped to requested size.
-	iw, ih := scaleAspect(img.Width, img.Height, width, height, false)
+	return img.Process([]Operation{{Type: OpCrop, Width: width, Height: height}})
+}
 
-	result, err := img.NewResult(iw, ih)
+// Process decodes the image once and applies each operation in order.
+func (img *Imager) Process(ops []Operation) ([]byte, error) {
+	result, err := img.Decode(ops)
 	if err != nil {
 		return nil, err
 	}
 	defer result.Close()
 
-	// Scale to appropriate intermediate size.
-	if err := result.Resize(iw, ih); err != nil {
-		return nil, err
+	for _, op := range ops {
+		if err := result.Apply(op); err != nil {
+			return nil, err
+		}
 	}
 
-	// If necessary, crop to fit exact size.
-	if result.Width > width || result.Height > height {
-		if err := result.Crop(width, height); err != nil {
+	return result.Get()
+}
+
+// Decode returns a Result ready for ops to be applied to it.  Only the first
+// operation sees the full-size image, so it alone decides how far the JPEG
+// decoder may pre-scale.  With GraphicFormat set, the image is first
+// classified, to pick the format it will be saved in.
+func (img *Imager) Decode(ops []Operation) (*Result, error) {
+	if img.GraphicFormat != "" {
+		class, err := img.Classify()
+		if err != nil {
 			return nil, err
 		}
+		if class == ContentGraphic {
+			img.OutputFormat = img.GraphicFormat
+		}
 	}
 
-	return result.Get()
+	var width, height uint
+	if len(ops) > 0 {
+		width, height = ops[0].scaled(img.Width, img.Height)
+	}
+
+	return img.NewResult(width, height)
 }
 
 func (img *Imager) Close() {
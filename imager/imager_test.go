@@ -5,7 +5,9 @@
 package imager
 
 import (
+	"bytes"
 	"fmt"
+	"github.com/gographics/imagick/imagick"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"strconv"
@@ -16,11 +18,22 @@ func TestImageValidation(t *testing.T) {
 	// Return UnknownFormat on a text file.
 	assert.Equal(t, tryNew("notimage.txt", 1000000), UnknownFormat)
 
-	// Return UnknownFormat on a truncated image.
-	assert.Equal(t, tryNew("bad.jpg", 1000000), UnknownFormat)
+	// Refuse vector and scripting formats, even when named like a JPEG.
+	for _, filename := range []string{"svg.jpg", "mvg.jpg", "msl.jpg"} {
+		assert.Equal(t, tryNew(filename, 1000000), UnknownFormat, filename)
+	}
+
+	// Return Truncated on a truncated image.
+	assert.Equal(t, tryNew("bad.jpg", 1000000), Truncated)
 
-	// Refuse to load a 1x1 pixel image.
-	assert.Equal(t, tryNew("1px.png", 1000000), UnknownFormat)
+	// Refuse to load a 1x1 pixel image, which decodes but is of no use.
+	assert.Equal(t, tryNew("1px.png", 1000000), TooSmall)
+
+	// Unless asked to.
+	img, err := NewMinimum(image("1px.png"), 1000000, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, img.Width, uint(1))
+	img.Close()
 
 	// Load a 2x2 pixel image.
 	assert.Nil(t, tryNew("2px.png", 1000000))
@@ -35,6 +48,138 @@ func TestImageValidation(t *testing.T) {
 	assert.Nil(t, tryNew("watermelon.jpg", 100000))
 }
 
+func TestImageDownscaling(t *testing.T) {
+	// As far as the decoder will, which 1/4 isn't.
+	img, err := NewDownscaling(image("watermelon.jpg"), 10000)
+	defer img.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, img.Width, uint(49))
+	assert.Equal(t, img.Height, uint(67))
+	assert.False(t, img.Unchanged(nil))
+
+	// Treat it as that size throughout.
+	thumb, err := img.Thumbnail(200, 200, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "JPEG", 49, 67))
+
+	thumb, err = img.Thumbnail(50, 50, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "JPEG", 37, 50))
+
+	img, err = NewDownscaling(image("watermelon.jpg"), 100000)
+	defer img.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, img.Width, uint(199))
+	assert.Equal(t, img.Height, uint(268))
+
+	// Images that fit are untouched.
+	img, err = NewDownscaling(image("watermelon.jpg"), 1000000)
+	defer img.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, img.Width, uint(398))
+
+	// Only JPEGs can be pre-scaled cheaply enough.
+	_, err = NewDownscaling(image("flowers.png"), 10000)
+	assert.Equal(t, err, TooBig)
+
+	// And only so far.
+	_, err = NewDownscaling(image("watermelon.jpg"), 1000)
+	assert.Equal(t, err, TooBig)
+}
+
+func TestCanEncode(t *testing.T) {
+	for _, format := range []string{"GIF", "JPEG", "PNG"} {
+		assert.True(t, CanEncode(format), format)
+	}
+
+	// Only probed formats are reported.
+	assert.False(t, CanEncode("TIFF"))
+	assert.False(t, CanEncode("NOTAFORMAT"))
+}
+
+func TestFormats(t *testing.T) {
+	encode, decode := Formats()
+	assert.Contains(t, encode, "JPEG")
+	assert.Contains(t, decode, "JPEG")
+
+	// Only formats New accepts are decodable.
+	assert.Contains(t, encode, "WEBP")
+	if CanDecode("WEBP") {
+		assert.Contains(t, decode, "WEBP")
+	}
+	assert.NotContains(t, decode, "AVIF")
+
+	assert.Contains(t, Version(), "ImageMagick")
+}
+
+func TestProbe(t *testing.T) {
+	info, err := Probe(image("watermelon.jpg"))
+	assert.Nil(t, err)
+	assert.Equal(t, *info, Info{Width: 398, Height: 536, Format: "JPEG"})
+
+	// Dimensions are reported upright.
+	info, err = Probe(image("orient6.jpg"))
+	assert.Nil(t, err)
+	assert.Equal(t, *info, Info{Width: 48, Height: 80, Format: "JPEG", Orientation: 6})
+
+	info, err = Probe(image("alpha.png"))
+	assert.Nil(t, err)
+	assert.Equal(t, *info, Info{Width: 32, Height: 32, Format: "PNG", HasAlpha: true})
+
+	info, err = Probe(image("animated.gif"))
+	assert.Nil(t, err)
+	assert.True(t, info.IsAnimated)
+
+	// Size limits are up to the caller.
+	info, err = Probe(image("34000px.png"))
+	assert.Nil(t, err)
+	assert.Equal(t, info.Width, uint(34000))
+
+	for _, filename := range []string{"notimage.txt", "svg.jpg"} {
+		_, err = Probe(image(filename))
+		assert.Equal(t, err, UnknownFormat, filename)
+	}
+}
+
+func TestWebpInput(t *testing.T) {
+	tests := []struct {
+		filename        string
+		alpha, animated bool
+	}{
+		{"lossy.webp", false, false},
+		{"lossless.webp", false, false},
+		{"alpha.webp", true, false},
+		{"alpha-lossless.webp", true, false},
+		{"animated.webp", false, true},
+	}
+
+	for _, test := range tests {
+		// Read from headers, without ImageMagick.
+		alpha, animated := webpFeatures(image(test.filename))
+		assert.Equal(t, alpha, test.alpha, test.filename)
+		assert.Equal(t, animated, test.animated, test.filename)
+
+		if !CanDecode("WEBP") {
+			continue
+		}
+
+		img, err := New(image(test.filename), 10000000)
+		assert.Nil(t, err, test.filename)
+		assert.Equal(t, img.InputFormat, "WEBP", test.filename)
+		assert.Equal(t, img.Width, uint(32), test.filename)
+		assert.Equal(t, img.Height, uint(24), test.filename)
+		img.Close()
+
+		info, err := Probe(image(test.filename))
+		assert.Nil(t, err, test.filename)
+		assert.Equal(t, *info, Info{Width: 32, Height: 24, Format: "WEBP", HasAlpha: test.alpha, IsAnimated: test.animated}, test.filename)
+	}
+
+	// The RIFF container alone isn't enough.
+	alpha, animated := webpFeatures([]byte("RIFF\x00\x00\x00\x00WAVEfmt "))
+	assert.False(t, alpha || animated)
+}
+
 func tryNew(filename string, maxBufferPixels uint) error {
 	img, err := New(image(filename), maxBufferPixels)
 	if img != nil {
@@ -82,59 +227,1751 @@ func TestImageCrop(t *testing.T) {
 	thumb, err = img.Crop(2000, 1500)
 	assert.Nil(t, err)
 	assert.Nil(t, isSize(thumb, "JPEG", 398, 299))
+
+	// Verify enlarging when allowed.
+	img.CropUpscale = UpscaleAllow
+	thumb, err = img.Crop(2000, 1500)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "JPEG", 2000, 1500))
+
+	// Verify refusing when not.
+	img.CropUpscale = UpscaleReject
+	_, err = img.Crop(2000, 1500)
+	assert.Equal(t, err, WouldUpscale)
+
+	// Verify reporting the region kept.
+	result, err := img.NewResult(0, 0)
+	assert.Nil(t, err)
+	defer result.Close()
+	assert.Nil(t, result.Crop(398, 398))
+	assert.Equal(t, *result.Cropped, Region{X: 0, Y: 69, Width: 398, Height: 398})
 }
 
-func TestImageRotation(t *testing.T) {
-	for i := 1; i <= 8; i++ {
-		// Verify that New() correctly translates dimensions.
-		img, err := New(image("orient"+strconv.Itoa(i)+".jpg"), 10000000)
-		defer img.Close()
-		assert.Nil(t, err)
-		assert.Equal(t, img.Width, uint(48))
-		assert.Equal(t, img.Height, uint(80))
+func TestImagePixelBudget(t *testing.T) {
+	img, err := New(image("watermelon.jpg"), 1000000)
+	defer img.Close()
+	assert.Nil(t, err)
+	img.CropUpscale = UpscaleAllow
 
-		// Verify that img.Thumbnail() maintains orientation.
-		thumb, err := img.Thumbnail(40, 40, true)
-		assert.Nil(t, err)
-		assert.Nil(t, isSize(thumb, "JPEG", 24, 40))
+	// Each step of a chain is held to the limit, even if the output isn't.
+	_, err = img.Process([]Operation{{Type: OpCrop, Width: 2000, Height: 2000}, {Type: OpScale, Width: 100, Height: 100}})
+	assert.Equal(t, err, TooBig)
 
-		// TODO: Figure out how to test crop.
-	}
+	thumb, err := img.Process([]Operation{{Type: OpCrop, Width: 900, Height: 900}, {Type: OpScale, Width: 100, Height: 100}})
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "JPEG", 100, 100))
+
+	// A JPEG New accepted because it can pre-scale is refused before
+	// decoding when nothing would let it.
+	img, err = New(image("watermelon.jpg"), 100000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	_, err = img.Process(nil)
+	assert.Equal(t, err, TooBig)
+
+	_, err = img.Process([]Operation{{Type: OpRotate, Degrees: 90}, {Type: OpScale, Width: 100, Height: 100}})
+	assert.Equal(t, err, TooBig)
+
+	thumb, err = img.Process([]Operation{{Type: OpScale, Width: 100, Height: 100}})
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "JPEG", 74, 100))
+
+	// The decoder only pre-scales by halves, so a size under the limit
+	// can still need a decode over it.
+	_, err = img.Process([]Operation{{Type: OpScale, Width: 300, Height: 300}})
+	assert.Equal(t, err, TooBig)
+
+	// The limit is per frame, so animations that keep their size fit it.
+	img, err = New(image("animated.gif"), 40*60)
+	defer img.Close()
+	assert.Nil(t, err)
+	img.AnimatedOutput = true
+	thumb, err = img.Process([]Operation{{Type: OpScale, Width: 40, Height: 60}})
+	assert.Nil(t, err)
+	assert.Nil(t, isFrames(thumb, img.Frames))
+	_, err = img.Process([]Operation{{Type: OpScale, Width: 80, Height: 120}})
+	assert.Equal(t, err, TooBig)
 }
 
-func TestImageFormat(t *testing.T) {
-	img, err := New(image("2px.gif"), 10000000)
+func TestImageUpscaleSharpen(t *testing.T) {
+	img, err := New(image("watermelon.jpg"), 10000000)
+	defer img.Close()
 	assert.Nil(t, err)
-	assert.Equal(t, img.Width, uint(2))
-	assert.Equal(t, img.Height, uint(3))
+	img.CropUpscale = UpscaleAllow
 
-	// Verify that we rewrite it as a PNG of the same size.
-	thumb, err := img.Thumbnail(1024, 1024, true)
+	// Enlarged images aren't sharpened by default.
+	plain, err := img.Crop(800, 1000)
 	assert.Nil(t, err)
-	assert.Nil(t, isSize(thumb, "PNG", 2, 3))
-	img.Close()
+	assert.Nil(t, isSize(plain, "JPEG", 800, 1000))
 
-	img, err = New(image("flowers.png"), 10000000)
+	// But may be, when asked.
+	img.UpscaleSharpen = true
+	sharpened, err := img.Crop(800, 1000)
 	assert.Nil(t, err)
-	assert.Equal(t, img.Width, uint(256))
-	assert.Equal(t, img.Height, uint(169))
+	assert.Nil(t, isSize(sharpened, "JPEG", 800, 1000))
+	assert.NotEqual(t, sharpened, plain)
+}
 
-	// Verify that we rewrite it as JPEG of the same size.
-	thumb, err = img.Thumbnail(1024, 1024, true)
+func TestImagePreviewQuality(t *testing.T) {
+	img, err := New(image("watermelon.jpg"), 10000000)
+	defer img.Close()
 	assert.Nil(t, err)
-	assert.Nil(t, isSize(thumb, "JPEG", 256, 169))
-	img.Close()
+
+	full, err := img.Thumbnail(200, 200, true)
+	assert.Nil(t, err)
+
+	// Previews use their own quality, regardless of JpegQuality.
+	img.Preview = true
+	img.PreviewQuality = 20
+	preview, err := img.Thumbnail(200, 200, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(preview, "JPEG", 149, 200))
+	assert.True(t, len(preview) < len(full))
 }
 
-func isSize(image []byte, format string, width, height uint) error {
-	img, err := New(image, 10000000)
+func TestImageJpegOptions(t *testing.T) {
+	img, err := New(image("watermelon.jpg"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	plain, err := img.Thumbnail(200, 200, true)
+	assert.Nil(t, err)
+
+	// Optimized Huffman tables are lossless, and never larger.
+	img.JpegOptimizeCoding = true
+	optimized, err := img.Thumbnail(200, 200, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(optimized, "JPEG", 149, 200))
+	assert.True(t, len(optimized) <= len(plain))
+	assert.Equal(t, rgba(optimized), rgba(plain))
+
+	// Another DCT method rounds differently.
+	img.JpegOptimizeCoding = false
+	img.JpegDctMethod = "float"
+	float, err := img.Thumbnail(200, 200, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(float, "JPEG", 149, 200))
+	assert.NotEqual(t, rgba(float), rgba(plain))
+}
+
+func TestImageDensity(t *testing.T) {
+	img, err := New(image("watermelon.jpg"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	// The tag survives stripping other metadata.
+	img.Density = 300
+	thumb, err := img.Thumbnail(200, 200, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "JPEG", 149, 200))
+	assert.Equal(t, resolution(thumb), 300.0)
+}
+
+// resolution returns the horizontal resolution image is tagged with, in
+// pixels per inch, or 0 if it's untagged or in other units.
+func resolution(image []byte) float64 {
+	wand := imagick.NewMagickWand()
+	defer wand.Destroy()
+	if err := wand.ReadImageBlob(image); err != nil {
+		return 0
+	}
+	if wand.GetImageUnits() != imagick.RESOLUTION_PIXELS_PER_INCH {
+		return 0
+	}
+	x, _, err := wand.GetImageResolution()
 	if err != nil {
-		return err
+		return 0
 	}
+	return x
+}
+
+func TestImageAutoContrast(t *testing.T) {
+	img, err := New(gradient(64, 96, 128), 10000000)
 	defer img.Close()
-	if width != img.Width || height != img.Height {
-		return fmt.Errorf("Width %d!=%d or Height %d!=%d", width, img.Width, height, img.Height)
+	assert.Nil(t, err)
+	img.AutoContrast = true
+
+	// Stretching all channels together keeps red darker than blue.
+	normalized, err := img.Thumbnail(64, 64, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(normalized, "PNG", 64, 64))
+	assert.Equal(t, channelMin(normalized, 0), byte(0))
+	assert.True(t, channelMax(normalized, 0) < 192)
+	assert.Equal(t, channelMax(normalized, 2), byte(255))
+
+	// Stretching each alone gives every one the full range.
+	img.AutoContrastMode = ContrastPerChannel
+	separate, err := img.Thumbnail(64, 64, true)
+	assert.Nil(t, err)
+	for channel := 0; channel < 3; channel++ {
+		assert.Equal(t, channelMin(separate, channel), byte(0))
+		assert.Equal(t, channelMax(separate, channel), byte(255))
+	}
+
+	// Equalizing adaptively is neither.
+	img.AutoContrastMode = ContrastCLAHE
+	equalized, err := img.Thumbnail(64, 64, true)
+	assert.Nil(t, err)
+	assert.NotEqual(t, rgba(equalized), rgba(normalized))
+	assert.NotEqual(t, rgba(equalized), rgba(separate))
+}
+
+func TestImageAutoLevelGamma(t *testing.T) {
+	img, err := New(gradient(16, 32, 48), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	// Levels stretch to the full range.
+	img.AutoLevel = true
+	leveled, err := img.Thumbnail(64, 64, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(leveled, "PNG", 64, 64))
+	assert.Equal(t, channelMin(leveled, 0), byte(0))
+	assert.Equal(t, channelMax(leveled, 2), byte(255))
+
+	// Gamma brightens a dark image's midtones.
+	img.AutoLevel = false
+	img.AutoGamma = true
+	brightened, err := img.Thumbnail(64, 64, true)
+	assert.Nil(t, err)
+	assert.True(t, channelMin(brightened, 0) > 16)
+	assert.True(t, channelMax(brightened, 2) > 111)
+
+	// And the two combine.
+	img.AutoLevel = true
+	both, err := img.Thumbnail(64, 64, true)
+	assert.Nil(t, err)
+	assert.Equal(t, channelMin(both, 0), byte(0))
+	assert.Equal(t, channelMax(both, 2), byte(255))
+	assert.NotEqual(t, rgba(both), rgba(leveled))
+}
+
+// gradient returns a 64x64 PNG that brightens from left to right by 64
+// levels in all, starting from the given red, green and blue.
+func gradient(red, green, blue byte) []byte {
+	rgb := make([]byte, 0, 64*64*3)
+	for y := 0; y < 64; y++ {
+		for x := byte(0); x < 64; x++ {
+			rgb = append(rgb, red+x, green+x, blue+x)
+		}
+	}
+
+	wand := imagick.NewMagickWand()
+	defer wand.Destroy()
+	background := imagick.NewPixelWand()
+	defer background.Destroy()
+	if !background.SetColor("black") {
+		panic("black isn't a color")
+	}
+	if err := wand.NewImage(64, 64, background); err != nil {
+		panic(err)
+	}
+	if err := wand.ImportImagePixels(0, 0, 64, 64, "RGB", imagick.PIXEL_CHAR, rgb); err != nil {
+		panic(err)
+	}
+	if err := wand.SetImageFormat("PNG"); err != nil {
+		panic(err)
+	}
+	return wand.GetImageBlob()
+}
+
+// channelMin returns the lowest value of a channel of image, from 0 for red
+// to 2 for blue.
+func channelMin(image []byte, channel int) byte {
+	pixels := rgba(image)
+	min := byte(255)
+	for i := channel; i < len(pixels); i += 4 {
+		if pixels[i] < min {
+			min = pixels[i]
+		}
+	}
+	return min
+}
+
+// channelMax returns the highest value of a channel of image.
+func channelMax(image []byte, channel int) byte {
+	pixels := rgba(image)
+	max := byte(0)
+	for i := channel; i < len(pixels); i += 4 {
+		if pixels[i] > max {
+			max = pixels[i]
+		}
+	}
+	return max
+}
+
+func TestImageSharpenCurve(t *testing.T) {
+	img, err := New(image("watermelon.jpg"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	fixed, err := img.Thumbnail(50, 50, true)
+	assert.Nil(t, err)
+
+	// Shrinking this much sharpens harder, adding detail to compress.
+	img.SharpenCurve = 0.5
+	curved, err := img.Thumbnail(50, 50, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(curved, "JPEG", 37, 50))
+	assert.True(t, len(curved) > len(fixed))
+
+	// Up to a limit.
+	img.SharpenMaxAmount = 0.6
+	capped, err := img.Thumbnail(50, 50, true)
+	assert.Nil(t, err)
+	assert.Equal(t, capped, fixed)
+}
+
+func TestImagePixelArt(t *testing.T) {
+	img, err := New(image("2px.png"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+	img.PixelArt = true
+
+	// Enlarge by the largest whole multiple that fits, 106.
+	thumb, err := img.Process([]Operation{{Type: OpScale, Width: 320, Height: 320}})
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "PNG", 212, 318))
+
+	// Every pixel is a copy of the top left of its block.
+	pixels := rgba(thumb)
+	assert.Equal(t, len(pixels), 212*318*4)
+	for i := 0; i < len(pixels); i += 4 {
+		x, y := i/4%212, i/4/212
+		j := (y/106*106*212 + x/106*106) * 4
+		if !bytes.Equal(pixels[i:i+4], pixels[j:j+4]) {
+			t.Errorf("pixel %d,%d isn't a copy of %d,%d", x, y, x/106*106, y/106*106)
+			break
+		}
 	}
+
+	// Crops cover by the smallest whole multiple, 160, then crop.
+	img.CropUpscale = UpscaleAllow
+	thumb, err = img.Crop(320, 320)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "PNG", 320, 320))
+
+	// Shrinking is unaffected.
+	img, err = New(image("watermelon.jpg"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+	img.PixelArt = true
+	thumb, err = img.Process([]Operation{{Type: OpScale, Width: 200, Height: 200}})
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "JPEG", 149, 200))
+}
+
+func TestImageBlurAfterResize(t *testing.T) {
+	img, err := New(image("watermelon.jpg"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+	img.Sharpen = false
+
+	sharp, err := img.Thumbnail(200, 200, true)
+	assert.Nil(t, err)
+
+	img.BlurFactor = 2
+	before, err := img.Thumbnail(200, 200, true)
+	assert.Nil(t, err)
+	assert.True(t, len(before) < len(sharp))
+
+	// Blurring either side of the resize softens the image, differently.
+	img.BlurAfterResize = true
+	after, err := img.Thumbnail(200, 200, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(after, "JPEG", 149, 200))
+	assert.True(t, len(after) < len(sharp))
+	assert.NotEqual(t, after, before)
+}
+
+func TestImageJpegRestartInterval(t *testing.T) {
+	img, err := New(image("watermelon.jpg"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+	img.Progressive = false
+
+	// No restart markers by default.
+	thumb, err := img.Thumbnail(200, 200, true)
+	assert.Nil(t, err)
+	assert.Equal(t, restartMarkers(thumb), 0)
+
+	img.JpegRestartInterval = 10
+	thumb, err = img.Thumbnail(200, 200, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "JPEG", 149, 200))
+	assert.True(t, restartMarkers(thumb) > 0)
+}
+
+func TestImageJpegRGB(t *testing.T) {
+	img, err := New(image("watermelon.jpg"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	// YCbCr by default, which needs no Adobe marker.
+	ycbcr, err := img.Thumbnail(200, 200, true)
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(ycbcr, []byte("Adobe")))
+
+	// libjpeg marks RGB with an Adobe marker saying there's no transform.
+	img.JpegRGB = true
+	rgb, err := img.Thumbnail(200, 200, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(rgb, "JPEG", 149, 200))
+	assert.True(t, bytes.Contains(rgb, []byte("Adobe")))
+	assert.True(t, len(rgb) > len(ycbcr))
+}
+
+func TestImageJpegKeepSampling(t *testing.T) {
+	img, err := New(image("watermelon.jpg"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+	source := sampling(image("watermelon.jpg"))
+	assert.NotEqual(t, source, "")
+
+	// ImageMagick doesn't subsample at high quality.
+	img.Quality = 95
+	thumb, err := img.Thumbnail(200, 200, true)
+	assert.Nil(t, err)
+	assert.Equal(t, sampling(thumb), "1x1,1x1,1x1")
+
+	img.JpegKeepSampling = true
+	thumb, err = img.Thumbnail(200, 200, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "JPEG", 149, 200))
+	assert.Equal(t, sampling(thumb), source)
+}
+
+func sampling(jpeg []byte) string {
+	wand := imagick.NewMagickWand()
+	defer wand.Destroy()
+	if err := wand.ReadImageBlob(jpeg); err != nil {
+		return ""
+	}
+	return wand.GetImageProperty("jpeg:sampling-factor")
+}
+
+// restartMarkers counts the RSTn markers in a JPEG's entropy-coded data,
+// where any other 0xff is followed by a 0x00 stuffing byte.
+func restartMarkers(jpeg []byte) int {
+	n := 0
+	for i := 0; i+1 < len(jpeg); i++ {
+		if jpeg[i] == 0xff && jpeg[i+1] >= 0xd0 && jpeg[i+1] <= 0xd7 {
+			n++
+		}
+	}
+	return n
+}
+
+func TestImageQuality(t *testing.T) {
+	if !CanEncode("WEBP") {
+		return
+	}
+
+	img, err := New(image("watermelon.jpg"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+	img.OutputFormat = "WEBP"
+
+	high, err := img.Thumbnail(200, 200, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(high, "WEBP", 149, 200))
+
+	img.Quality = 30
+	low, err := img.Thumbnail(200, 200, true)
+	assert.Nil(t, err)
+	assert.True(t, len(low) < len(high))
+}
+
+func TestImageJpegQualityCurve(t *testing.T) {
+	img, err := New(image("watermelon.jpg"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	result, err := img.NewResult(0, 0)
+	assert.Nil(t, err)
+	defer result.Close()
+
+	// Fixed by default.
+	assert.Equal(t, result.jpegQuality(), uint(85))
+
+	img.JpegQualityCurve = []QualityPoint{{Pixels: 10000, Quality: 60}, {Pixels: 1000000, Quality: 90}}
+	for _, test := range []struct{ width, height, quality uint }{
+		{50, 50, 60},     // Below the curve.
+		{100, 100, 60},   // Its first point.
+		{316, 316, 75},   // Halfway, by logarithm.
+		{1000, 1000, 90}, // Its last point.
+		{2000, 2000, 90}, // Beyond it.
+	} {
+		result.Width, result.Height = test.width, test.height
+		assert.Equal(t, result.jpegQuality(), test.quality, test.width)
+	}
+
+	// Smaller outputs come out smaller for it.
+	img.JpegQualityCurve = []QualityPoint{{Pixels: 10000, Quality: 30}, {Pixels: 100000, Quality: 95}}
+	curved, err := img.Thumbnail(100, 100, true)
+	assert.Nil(t, err)
+	img.JpegQualityCurve = nil
+	fixed, err := img.Thumbnail(100, 100, true)
+	assert.Nil(t, err)
+	assert.True(t, len(curved) < len(fixed))
+}
+
+func TestImageProgressive(t *testing.T) {
+	img, err := New(image("watermelon.jpg"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	// Progressive by default.
+	thumb, err := img.Thumbnail(200, 200, true)
+	assert.Nil(t, err)
+	assert.Equal(t, interlace(thumb), imagick.INTERLACE_JPEG)
+
+	img.Progressive = false
+	thumb, err = img.Thumbnail(200, 200, true)
+	assert.Nil(t, err)
+	assert.Equal(t, interlace(thumb), imagick.INTERLACE_NO)
+
+	// But previews always are.
+	img.Preview = true
+	thumb, err = img.Thumbnail(200, 200, true)
+	assert.Nil(t, err)
+	assert.Equal(t, interlace(thumb), imagick.INTERLACE_JPEG)
+
+	// Even tiny ones.
+	thumb, err = img.Thumbnail(64, 64, true)
+	assert.Nil(t, err)
+	assert.Equal(t, interlace(thumb), imagick.INTERLACE_JPEG)
+
+	// Other tiny outputs aren't, unless there's no minimum.
+	img.Preview = false
+	img.Progressive = true
+	thumb, err = img.Thumbnail(64, 64, true)
+	assert.Nil(t, err)
+	assert.Equal(t, interlace(thumb), imagick.INTERLACE_NO)
+
+	img.ProgressiveMinPixels = 0
+	thumb, err = img.Thumbnail(64, 64, true)
+	assert.Nil(t, err)
+	assert.Equal(t, interlace(thumb), imagick.INTERLACE_JPEG)
+}
+
+func TestImageFormatInterlace(t *testing.T) {
+	img, err := New(image("flowers.png"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	// PNG isn't interlaced by default, as Adam7 compresses worse.
+	thumb, err := img.Thumbnail(200, 200, true)
+	assert.Nil(t, err)
+	assert.Equal(t, interlace(thumb), imagick.INTERLACE_NO)
+	plain := thumb
+
+	// Each format interlaces its own way, when asked.
+	img.Interlace = map[string]bool{"PNG": true}
+	thumb, err = img.Thumbnail(200, 200, true)
+	assert.Nil(t, err)
+	assert.Equal(t, interlace(thumb), imagick.INTERLACE_PNG)
+	assert.True(t, len(thumb) > len(plain))
+
+	// Adam7 decodes to the same pixels.
+	assert.Equal(t, pixelColor(thumb, 100, 66), pixelColor(plain, 100, 66))
+
+	img.OutputFormat = "JPEG"
+	thumb, err = img.Thumbnail(200, 200, true)
+	assert.Nil(t, err)
+	assert.Equal(t, interlace(thumb), imagick.INTERLACE_JPEG)
+
+	// Even when otherwise off.
+	img.Progressive = false
+	img.Interlace = map[string]bool{"JPEG": true}
+	thumb, err = img.Thumbnail(200, 200, true)
+	assert.Nil(t, err)
+	assert.Equal(t, interlace(thumb), imagick.INTERLACE_JPEG)
+
+	// Tiny output still isn't.
+	thumb, err = img.Thumbnail(64, 64, true)
+	assert.Nil(t, err)
+	assert.Equal(t, interlace(thumb), imagick.INTERLACE_NO)
+}
+
+func interlace(image []byte) imagick.InterlaceType {
+	wand := imagick.NewMagickWand()
+	defer wand.Destroy()
+	if err := wand.PingImageBlob(image); err != nil {
+		return imagick.INTERLACE_UNDEFINED
+	}
+	return wand.GetImageInterlaceScheme()
+}
+
+func TestImageCropPercent(t *testing.T) {
+	img, err := New(image("watermelon.jpg"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	// Percentages of the image, whatever its size.
+	thumb, err := img.Process([]Operation{{Type: OpCropPercent, Width: 80, Height: 50}})
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "JPEG", 318, 268))
+
+	// Of the image as it is at that point in the chain.
+	thumb, err = img.Process([]Operation{{Type: OpScale, Width: 200, Height: 200}, {Type: OpCropPercent, Width: 50, Height: 50, Gravity: GravityNorthWest}})
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "JPEG", 75, 100))
+
+	thumb, err = img.Process([]Operation{{Type: OpCropPercent, Width: 100, Height: 100}})
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "JPEG", 398, 536))
+}
+
+func TestImageProcess(t *testing.T) {
+	img, err := New(image("watermelon.jpg"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	// Verify a single operation matches Crop().
+	thumb, err := img.Process([]Operation{{Type: OpCrop, Width: 300, Height: 400}})
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "JPEG", 300, 400))
+
+	// Verify operations are applied in order.
+	thumb, err = img.Process([]Operation{{Type: OpCrop, Width: 200, Height: 100}, {Type: OpScale, Width: 100, Height: 100}})
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "JPEG", 100, 50))
+
+	// Verify aspect ratio crops keep the most area.
+	thumb, err = img.Process([]Operation{{Type: OpAspect, Width: 16, Height: 9}})
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "JPEG", 398, 224))
+
+	// Verify fills crop like OpCrop, but by gravity.
+	thumb, err = img.Process([]Operation{{Type: OpFill, Width: 200, Height: 100, Gravity: GravityNorth}})
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "JPEG", 200, 100))
+
+	result, err := img.NewResult(0, 0)
+	assert.Nil(t, err)
+	defer result.Close()
+	assert.Nil(t, result.Apply(Operation{Type: OpFill, Width: 398, Height: 200, Gravity: GravitySouth}))
+	assert.Equal(t, *result.Cropped, Region{X: 0, Y: 336, Width: 398, Height: 200})
+}
+
+func TestImageAssumeProfile(t *testing.T) {
+	img, err := New(image("watermelon.jpg"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	plain, err := img.Thumbnail(100, 100, true)
+	assert.Nil(t, err)
+
+	// Untagged images may be declared to be in another color space, and
+	// are converted from it.
+	img.AssumeProfile = []byte(compactDisplayP3)
+	thumb, err := img.Thumbnail(100, 100, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "JPEG", 74, 100))
+
+	before, after := rgba(plain), rgba(thumb)
+	assert.Equal(t, len(after), len(before))
+	shift := 0
+	for i := range before {
+		if d := int(after[i]) - int(before[i]); d > shift {
+			shift = d
+		} else if -d > shift {
+			shift = -d
+		}
+	}
+	assert.True(t, shift > 8, shift)
+
+	// Which is stripped from the output, like any other profile.
+	assert.Equal(t, profile(thumb, "icc"), "")
+}
+
+func TestImageCMYKProfile(t *testing.T) {
+	// The left half of each is 100% cyan ink, which cmyk.icc prints as a
+	// realistic blue-green, rather than the pure cyan of a naive conversion.
+	calibrated := func(thumb []byte) bool {
+		rgb := pixelColor(thumb, 16, 32)
+		return len(rgb) == 3 && rgb[0] < 0.2 && rgb[1] > 0.4 && rgb[1] < 0.75 && rgb[2] > 0.6
+	}
+
+	img, err := New(image("cmyk-profile.jpg"), 10000000)
+	assert.Nil(t, err)
+	thumb, err := img.Thumbnail(64, 64, true)
+	assert.Nil(t, err)
+	assert.True(t, calibrated(thumb), pixelColor(thumb, 16, 32))
+	img.Close()
+
+	img, err = New(image("cmyk.jpg"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+	thumb, err = img.Thumbnail(64, 64, true)
+	assert.Nil(t, err)
+	assert.False(t, calibrated(thumb), pixelColor(thumb, 16, 32))
+
+	// Untagged CMYK may be declared to use the same profile.
+	img.AssumeCMYKProfile = image("cmyk.icc")
+	thumb, err = img.Thumbnail(64, 64, true)
+	assert.Nil(t, err)
+	assert.True(t, calibrated(thumb), pixelColor(thumb, 16, 32))
+}
+
+func TestImageUnchanged(t *testing.T) {
+	img, err := New(image("watermelon.jpg"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	small := Operation{Type: OpDownscale, Width: 200, Height: 200}
+	large := Operation{Type: OpDownscale, Width: 1000, Height: 1000}
+	assert.True(t, img.Unchanged([]Operation{large}))
+	assert.True(t, img.Unchanged([]Operation{large, large}))
+	assert.False(t, img.Unchanged([]Operation{small}))
+	assert.False(t, img.Unchanged([]Operation{{Type: OpScale, Width: 1000, Height: 1000}}))
+
+	// A border always changes it.
+	img.BorderWidth = 10
+	assert.False(t, img.Unchanged([]Operation{large}))
+	img.BorderWidth = 0
+
+	// Downscaling never enlarges.
+	thumb, err := img.Process([]Operation{small, large})
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "JPEG", 149, 200))
+
+	// As does taking a still from an animation.
+	img, err = New(image("animated.gif"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+	assert.False(t, img.Unchanged([]Operation{large}))
+	img.AnimatedOutput = true
+	assert.True(t, img.Unchanged([]Operation{large}))
+}
+
+func TestImageDefines(t *testing.T) {
+	img, err := New(image("flowers.png"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+	img.OutputFormat = "PNG"
+
+	fast, err := img.Thumbnail(200, 200, true)
+	assert.Nil(t, err)
+
+	// Allowed coder options are passed through.
+	img.Defines = map[string]string{"png:compression-level": "0"}
+	uncompressed, err := img.Thumbnail(200, 200, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(uncompressed, "PNG", 200, 132))
+	assert.True(t, len(uncompressed) > len(fast))
+
+	// Others are refused.
+	img.Defines = map[string]string{"temporary-path": "/etc"}
+	_, err = img.Thumbnail(200, 200, true)
+	assert.Equal(t, err, ForbiddenDefine)
+}
+
+func TestImageRotate(t *testing.T) {
+	img, err := New(image("watermelon.jpg"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	// Quarter turns just swap dimensions.
+	thumb, err := img.Process([]Operation{{Type: OpCrop, Width: 200, Height: 100}, {Type: OpRotate, Degrees: 90}})
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "JPEG", 100, 200))
+
+	// Exposed corners are filled with the background color.
+	thumb, err = img.Process([]Operation{{Type: OpCrop, Width: 100, Height: 100}, {Type: OpRotate, Degrees: 45}})
+	assert.Nil(t, err)
+	assert.Nil(t, isFormat(thumb, "JPEG"))
+
+	// A transparent fill needs an output format with alpha.
+	img.BackgroundColor = "none"
+	thumb, err = img.Process([]Operation{{Type: OpCrop, Width: 100, Height: 100}, {Type: OpRotate, Degrees: 45}})
+	assert.Nil(t, err)
+	assert.Nil(t, isFormat(thumb, "PNG"))
+
+	img.BackgroundColor = "notacolor"
+	_, err = img.Process([]Operation{{Type: OpRotate, Degrees: 45}})
+	assert.Equal(t, err, BadColor)
+}
+
+func TestResultComposite(t *testing.T) {
+	img, err := New(image("watermelon.jpg"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	result, err := img.Decode(nil)
+	assert.Nil(t, err)
+	plain, err := result.Clone().Get()
+	assert.Nil(t, err)
+	assert.Nil(t, result.Composite(image("graphic.png"), GravitySouthEast, 10, 10, 0.5, BlendMultiply))
+	thumb, err := result.Get()
+	assert.Nil(t, err)
+	result.Close()
+
+	// Overlays don't change the size, but change the output.
+	assert.Nil(t, isSize(thumb, "JPEG", 398, 536))
+	assert.NotEqual(t, thumb, plain)
+
+	// Overlays are validated like any other image.
+	result, err = img.Decode(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, result.Composite(image("notimage.txt"), GravityCenter, 0, 0, 1, BlendOver), UnknownFormat)
+	assert.Equal(t, result.Composite(image("graphic.png"), GravityCenter, 0, 0, 1, BlendMode(-1)), UnknownBlendMode)
+	result.Close()
+
+	// Including the pixel limit, at full size.
+	img, err = New(image("watermelon.jpg"), 100000)
+	defer img.Close()
+	assert.Nil(t, err)
+	result, err = img.Decode([]Operation{{Type: OpScale, Width: 100, Height: 100}})
+	assert.Nil(t, err)
+	assert.Equal(t, result.Composite(image("watermelon.jpg"), GravityCenter, 0, 0, 1, BlendOver), TooBig)
+	result.Close()
+}
+
+func TestGravityOffset(t *testing.T) {
+	x, y := GravityCenter.offset(100, 50, 11, 10)
+	assert.Equal(t, []int{x, y}, []int{45, 20})
+	x, y = GravityNorthWest.offset(100, 50, 11, 10)
+	assert.Equal(t, []int{x, y}, []int{0, 0})
+	x, y = GravitySouthEast.offset(100, 50, 11, 10)
+	assert.Equal(t, []int{x, y}, []int{89, 40})
+	x, y = GravityEast.offset(100, 50, 11, 10)
+	assert.Equal(t, []int{x, y}, []int{89, 20})
+	x, y = GravityNorth.offset(100, 50, 11, 10)
+	assert.Equal(t, []int{x, y}, []int{45, 0})
+}
+
+func TestImageBatch(t *testing.T) {
+	img, err := New(image("watermelon.jpg"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	blobs, err := img.Batch([]Variant{
+		{Operations: []Operation{{Type: OpScale, Width: 200, Height: 300}}},
+		{Operations: []Operation{{Type: OpCrop, Width: 100, Height: 100}}, Format: "PNG"},
+		{},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, len(blobs), 3)
+	assert.Nil(t, isSize(blobs[0], "JPEG", 200, 269))
+	assert.Nil(t, isSize(blobs[1], "PNG", 100, 100))
+	assert.Nil(t, isSize(blobs[2], "JPEG", 398, 536))
+}
+
+func TestImageWebpAlphaQuality(t *testing.T) {
+	img, err := New(image("alpha.png"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	webp := []Variant{{Format: "WEBP"}}
+	blobs, err := img.Batch(webp)
+	assert.Nil(t, err)
+	lossless := blobs[0]
+	assert.Equal(t, formatOf(lossless), "WEBP")
+
+	// Verify lossy alpha is smaller.
+	img.WebpAlphaQuality = 10
+	blobs, err = img.Batch(webp)
+	assert.Nil(t, err)
+	assert.True(t, len(blobs[0]) < len(lossless))
+}
+
+func TestImageWebpLossless(t *testing.T) {
+	img, err := New(image("alpha.png"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	img.WebpLossless = true
+	blobs, err := img.Batch([]Variant{{Format: "WEBP"}})
+	assert.Nil(t, err)
+	assert.Equal(t, formatOf(blobs[0]), "WEBP")
+
+	// Alpha must survive bit for bit, as must color wherever it's visible.
+	orig, webp := rgba(image("alpha.png")), rgba(blobs[0])
+	assert.Equal(t, len(webp), 32*32*4)
+	assert.Equal(t, len(orig), len(webp))
+	for i := 0; i+4 <= len(orig) && i+4 <= len(webp); i += 4 {
+		assert.Equal(t, webp[i+3], orig[i+3], i/4)
+		if orig[i+3] != 0 {
+			assert.Equal(t, webp[i:i+3], orig[i:i+3], i/4)
+		}
+	}
+}
+
+func rgba(image []byte) []byte {
+	wand := imagick.NewMagickWand()
+	defer wand.Destroy()
+	if err := wand.ReadImageBlob(image); err != nil {
+		return nil
+	}
+	pixels, err := wand.ExportImagePixels(0, 0, wand.GetImageWidth(), wand.GetImageHeight(), "RGBA", imagick.PIXEL_CHAR)
+	if err != nil {
+		return nil
+	}
+	rgba, _ := pixels.([]byte)
+	return rgba
+}
+
+func formatOf(image []byte) string {
+	wand := imagick.NewMagickWand()
+	defer wand.Destroy()
+	if err := wand.PingImageBlob(image); err != nil {
+		return ""
+	}
+	return wand.GetImageFormat()
+}
+
+func TestResultClone(t *testing.T) {
+	img, err := New(image("watermelon.jpg"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	result, err := img.NewResult(0, 0)
+	assert.Nil(t, err)
+
+	// Changes to a clone don't affect the original, which outlives it.
+	clone := result.Clone()
+	assert.Nil(t, clone.Resize(100, 134))
+	thumb, err := clone.Get()
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "JPEG", 100, 134))
+	clone.Close()
+
+	thumb, err = result.Get()
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "JPEG", 398, 536))
+	result.Close()
+}
+
+func TestImageExifThumbnail(t *testing.T) {
+	// Verify that we return the embedded 48x80 thumbnail.
+	img, err := New(image("exifthumb.jpg"), 10000000)
+	assert.Nil(t, err)
+	thumb, err := img.ExifThumbnail(100, 100)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "JPEG", 48, 80))
+	img.Close()
+
+	// Verify that we generate one when there isn't one embedded.
+	img, err = New(image("watermelon.jpg"), 10000000)
+	assert.Nil(t, err)
+	thumb, err = img.ExifThumbnail(100, 100)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "JPEG", 74, 100))
+	img.Close()
+}
+
+func TestImageMPF(t *testing.T) {
+	// mpf.jpg starts with a 48x80 preview, followed by the primary image.
+	assert.Equal(t, mpfPrimary(image("mpf.jpg")), image("watermelon.jpg"))
+	assert.Equal(t, mpfPrimary(image("watermelon.jpg")), image("watermelon.jpg"))
+
+	img, err := New(image("mpf.jpg"), 10000000)
+	assert.Nil(t, err)
+	assert.Equal(t, img.Width, uint(398))
+	assert.Equal(t, img.Height, uint(536))
+	thumb, err := img.Thumbnail(100, 100, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "JPEG", 74, 100))
+	img.Close()
+}
+
+func TestImageTruncated(t *testing.T) {
+	img, err := New(image("truncated.jpg"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	// Refuse to render partial data by default.
+	_, err = img.Thumbnail(100, 100, true)
+	assert.Equal(t, err, Truncated)
+
+	// But render what we can when asked to.
+	img.BestEffort = true
+	thumb, err := img.Thumbnail(100, 100, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "JPEG", 74, 100))
+}
+
+func TestImageRotation(t *testing.T) {
+	for i := 1; i <= 8; i++ {
+		// Verify that New() correctly translates dimensions.
+		img, err := New(image("orient"+strconv.Itoa(i)+".jpg"), 10000000)
+		defer img.Close()
+		assert.Nil(t, err)
+		assert.Equal(t, img.Width, uint(48))
+		assert.Equal(t, img.Height, uint(80))
+		assert.Equal(t, img.Orientation.Tag(), uint(i))
+
+		// Verify that img.Thumbnail() maintains orientation.
+		thumb, err := img.Thumbnail(40, 40, true)
+		assert.Nil(t, err)
+		assert.Nil(t, isSize(thumb, "JPEG", 24, 40))
+
+		// Each fixture is an "F" once oriented, so mirroring or
+		// rotating it wrong moves the stem or the top bar.
+		assert.Nil(t, isDark(thumb, map[[2]int]bool{{2, 2}: true, {20, 2}: true, {2, 35}: true, {20, 35}: false}), i)
+
+		// Verify that img.Crop() takes the same part of each.
+		thumb, err = img.Crop(40, 40)
+		assert.Nil(t, err)
+		assert.Nil(t, isSize(thumb, "JPEG", 40, 40))
+		assert.Nil(t, isDark(thumb, map[[2]int]bool{{2, 35}: true, {35, 35}: false}), i)
+	}
+}
+
+func TestImagePreviewRotation(t *testing.T) {
+	for i := 1; i <= 8; i++ {
+		img, err := New(image("orient"+strconv.Itoa(i)+".jpg"), 10000000)
+		defer img.Close()
+		assert.Nil(t, err)
+
+		// Previews are fixed, color managed, and stripped like anything else.
+		img.Preview = true
+		thumb, err := img.Thumbnail(40, 40, true)
+		assert.Nil(t, err)
+		assert.Nil(t, isSize(thumb, "JPEG", 24, 40), i)
+		assert.Nil(t, isDark(thumb, map[[2]int]bool{{2, 2}: true, {20, 2}: true, {2, 35}: true, {20, 35}: false}), i)
+		assert.Equal(t, profile(thumb, "exif"), "", i)
+	}
+
+	img, err := New(image("cmyk-profile.jpg"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+	img.Preview = true
+	thumb, err := img.Thumbnail(100, 100, true)
+	assert.Nil(t, err)
+	assert.Equal(t, profile(thumb, "icc"), "")
+}
+
+// pixelColor returns the red, green, and blue of a pixel of image, from 0 to 1.
+func pixelColor(image []byte, x, y int) []float64 {
+	wand := imagick.NewMagickWand()
+	defer wand.Destroy()
+	if err := wand.ReadImageBlob(image); err != nil {
+		return nil
+	}
+
+	color, err := wand.GetImagePixelColor(x, y)
+	if err != nil {
+		return nil
+	}
+	defer color.Destroy()
+	return []float64{color.GetRed(), color.GetGreen(), color.GetBlue()}
+}
+
+// isDark checks whether each of the given pixels of image is dark.
+func isDark(image []byte, pixels map[[2]int]bool) error {
+	wand := imagick.NewMagickWand()
+	defer wand.Destroy()
+	if err := wand.ReadImageBlob(image); err != nil {
+		return err
+	}
+
+	for xy, dark := range pixels {
+		color, err := wand.GetImagePixelColor(xy[0], xy[1])
+		if err != nil {
+			return err
+		}
+		brightness := (color.GetRed() + color.GetGreen() + color.GetBlue()) / 3
+		color.Destroy()
+		if (brightness < 0.5) != dark {
+			return fmt.Errorf("Pixel %v brightness %.2f, expected dark=%v", xy, brightness, dark)
+		}
+	}
+	return nil
+}
+
+func TestImageFormat(t *testing.T) {
+	img, err := New(image("2px.gif"), 10000000)
+	assert.Nil(t, err)
+	assert.Equal(t, img.Width, uint(2))
+	assert.Equal(t, img.Height, uint(3))
+
+	// Verify that we rewrite it as a PNG of the same size.
+	thumb, err := img.Thumbnail(1024, 1024, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "PNG", 2, 3))
+	img.Close()
+
+	img, err = New(image("flowers.png"), 10000000)
+	assert.Nil(t, err)
+	assert.Equal(t, img.Width, uint(256))
+	assert.Equal(t, img.Height, uint(169))
+
+	// Verify that we rewrite it as JPEG of the same size.
+	thumb, err = img.Thumbnail(1024, 1024, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "JPEG", 256, 169))
+	img.Close()
+}
+
+func TestImageClassify(t *testing.T) {
+	for filename, class := range map[string]ContentClass{
+		"watermelon.jpg": ContentPhoto,
+		"flowers.png":    ContentPhoto,
+		"graphic.png":    ContentGraphic,
+	} {
+		img, err := New(image(filename), 10000000)
+		assert.Nil(t, err)
+		c, err := img.Classify()
+		assert.Nil(t, err)
+		assert.Equal(t, c, class, filename)
+		img.Close()
+	}
+}
+
+func TestImageGraphicFormat(t *testing.T) {
+	for filename, format := range map[string]string{
+		"watermelon.jpg": "JPEG",
+		"graphic.png":    "PNG",
+	} {
+		img, err := New(image(filename), 10000000)
+		assert.Nil(t, err)
+		img.OutputFormat = "JPEG"
+		img.GraphicFormat = "PNG"
+		blob, err := img.Crop(32, 32)
+		assert.Nil(t, err)
+		assert.Nil(t, isFormat(blob, format), filename)
+		img.Close()
+	}
+}
+
+func TestFlatFraction(t *testing.T) {
+	// Two rows of two pixels: one flat pair, one not.
+	assert.Equal(t, flatFraction([]byte{1, 2, 3, 1, 2, 3, 1, 2, 3, 9, 9, 9}, 2), 0.5)
+
+	// Don't compare across rows.
+	assert.Equal(t, flatFraction([]byte{1, 2, 3, 4, 5, 6, 4, 5, 6, 7, 8, 9}, 2), 0.0)
+}
+
+func TestImageKeepXMP(t *testing.T) {
+	for _, filename := range []string{"xmp.jpg", "xmp.png"} {
+		img, err := New(image(filename), 10000000)
+		assert.Nil(t, err)
+
+		// Verify that XMP is stripped by default.
+		thumb, err := img.Thumbnail(2, 2, true)
+		assert.Nil(t, err)
+		assert.Equal(t, profile(thumb, "xmp"), "", filename)
+
+		// And survives when requested.
+		img.KeepXMP = true
+		thumb, err = img.Thumbnail(2, 2, true)
+		assert.Nil(t, err)
+		assert.Contains(t, profile(thumb, "xmp"), "<dc:rights>fotomat test</dc:rights>", filename)
+		img.Close()
+	}
+}
+
+func TestImageGrayscale(t *testing.T) {
+	img, err := New(image("gray.jpg"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	// Grayscale stays single-channel, and so smaller.
+	gray, err := img.Thumbnail(48, 48, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(gray, "JPEG", 48, 32))
+	assert.Equal(t, jpegComponents(gray), 1)
+
+	img.KeepGrayscale = false
+	promoted, err := img.Thumbnail(48, 48, true)
+	assert.Nil(t, err)
+	assert.Equal(t, jpegComponents(promoted), 3)
+	assert.True(t, len(gray) < len(promoted))
+
+	// Unless color is added.
+	img.KeepGrayscale = true
+	img.BackgroundColor = "red"
+	rotated, err := img.Process([]Operation{{Type: OpRotate, Degrees: 45}})
+	assert.Nil(t, err)
+	assert.Equal(t, jpegComponents(rotated), 3)
+
+	img.BorderWidth = 2
+	img.BorderColor = "blue"
+	framed, err := img.Thumbnail(48, 48, true)
+	assert.Nil(t, err)
+	assert.Equal(t, jpegComponents(framed), 3)
+	img.BorderWidth = 0
+
+	padded, err := img.Process([]Operation{{Type: OpScale, Width: 48, Height: 48, Pad: PadMatte}})
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(padded, "JPEG", 48, 48))
+	assert.Equal(t, jpegComponents(padded), 3)
+	assert.True(t, pixelColor(padded, 24, 1)[0] > 0.9)
+}
+
+func TestDominantColor(t *testing.T) {
+	img, err := New(image("gray.jpg"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	result, err := img.Decode(nil)
+	assert.Nil(t, err)
+	defer result.Close()
+
+	// A gray image's dominant color is gray.
+	color, err := result.DominantColor()
+	assert.Nil(t, err)
+	assert.Equal(t, len(color), 7)
+	assert.Equal(t, color[1:3], color[3:5])
+	assert.Equal(t, color[3:5], color[5:7])
+
+	// Every pixel may be counted instead, for accuracy.
+	img.ColorSampleSize = 0
+	full, err := result.DominantColor()
+	assert.Nil(t, err)
+	assert.Equal(t, full[1:3], full[3:5])
+
+	// Palettes are distinct colors, most common first.
+	palette, err := result.Palette(4)
+	assert.Nil(t, err)
+	assert.Equal(t, len(palette), 4)
+	assert.Equal(t, palette[0], full)
+	assert.NotEqual(t, palette[1], palette[0])
+}
+
+func TestImageStillFrame(t *testing.T) {
+	img, err := New(image("animated.gif"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	first, err := img.Thumbnail(20, 20, true)
+	assert.Nil(t, err)
+
+	// Any frame may be chosen instead, complete rather than just what changed.
+	img.StillFrame = StillIndex
+	img.FrameIndex = 2
+	last, err := img.Thumbnail(20, 20, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isFrames(last, 1))
+	assert.Nil(t, isSize(last, "GIF", 13, 20))
+	assert.NotEqual(t, last, first)
+
+	// Numbers past the end mean the last frame.
+	img.FrameIndex = 99
+	thumb, err := img.Thumbnail(20, 20, true)
+	assert.Nil(t, err)
+	assert.Equal(t, thumb, last)
+
+	img.StillFrame = StillBest
+	thumb, err = img.Thumbnail(20, 20, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isFrames(thumb, 1))
+
+	// Scoring just one frame can only pick the first.
+	img.MaxScoredFrames = 1
+	thumb, err = img.Thumbnail(20, 20, true)
+	assert.Nil(t, err)
+	img.StillFrame = StillIndex
+	img.FrameIndex = 0
+	zero, err := img.Thumbnail(20, 20, true)
+	assert.Nil(t, err)
+	assert.Equal(t, thumb, zero)
+
+	// Only stills are affected.
+	img.AnimatedOutput = true
+	thumb, err = img.Thumbnail(20, 20, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isFrames(thumb, 3))
+}
+
+func TestResultGetSmallest(t *testing.T) {
+	if !CanEncode("WEBP") {
+		return
+	}
+
+	img, err := New(image("watermelon.jpg"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	result, err := img.Decode(nil)
+	assert.Nil(t, err)
+	defer result.Close()
+	assert.Nil(t, result.Resize(150, 200))
+
+	jpeg, err := result.GetAs("JPEG")
+	assert.Nil(t, err)
+	webp, err := result.GetAs("WEBP")
+	assert.Nil(t, err)
+
+	smallest, err := result.GetSmallest([]string{"JPEG", "WEBP"})
+	assert.Nil(t, err)
+	if len(webp) < len(jpeg) {
+		assert.Equal(t, smallest, webp)
+	} else {
+		assert.Equal(t, smallest, jpeg)
+	}
+
+	// Formats other than those listed are saved as usual.
+	img, err = New(image("flowers.png"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+	result, err = img.Decode(nil)
+	assert.Nil(t, err)
+	defer result.Close()
+	png, err := result.GetSmallest([]string{"JPEG", "WEBP"})
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(png, "PNG", img.Width, img.Height))
+}
+
+func TestImageBorder(t *testing.T) {
+	img, err := New(image("watermelon.jpg"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	// The frame adds to the size.
+	img.BorderWidth = 10
+	img.BorderColor = "blue"
+	thumb, err := img.Thumbnail(200, 200, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "JPEG", 169, 220))
+	for _, rgb := range [][]float64{pixelColor(thumb, 2, 2), pixelColor(thumb, 166, 217)} {
+		assert.True(t, rgb[0] < 0.1 && rgb[2] > 0.9, rgb)
+	}
+
+	// Or the image shrinks within it.
+	img.BorderInside = true
+	thumb, err = img.Thumbnail(200, 200, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "JPEG", 149, 200))
+
+	img.BorderColor = "fuchsia-ish"
+	_, err = img.Thumbnail(200, 200, true)
+	assert.Equal(t, err, BadColor)
+}
+
+// jpegComponents returns the number of color components in a JPEG's frame
+// header, or 0 if there isn't one.
+func jpegComponents(jpeg []byte) int {
+	for i := 2; i+9 < len(jpeg) && jpeg[i] == 0xff; {
+		marker := jpeg[i+1]
+		if marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc {
+			return int(jpeg[i+9])
+		}
+		i += 2 + int(jpeg[i+2])<<8 + int(jpeg[i+3])
+	}
+	return 0
+}
+
+func TestImageEmbedSRGB(t *testing.T) {
+	for _, filename := range []string{"watermelon.jpg", "2px.png"} {
+		img, err := New(image(filename), 10000000)
+		assert.Nil(t, err)
+
+		// Verify profiles are stripped by default.
+		thumb, err := img.Thumbnail(100, 100, true)
+		assert.Nil(t, err)
+		assert.Equal(t, profile(thumb, "icc"), "", filename)
+
+		// And replaced with a compact sRGB one when requested.
+		img.EmbedSRGB = true
+		thumb, err = img.Thumbnail(100, 100, true)
+		assert.Nil(t, err)
+		assert.Equal(t, profile(thumb, "icc"), compactSRGB, filename)
+		img.Close()
+	}
+}
+
+func TestImageWideGamut(t *testing.T) {
+	// p3.jpg is Display P3 (0.8, 0.3, 0.3), which is sRGB (0.867, 0.25, 0.278).
+	img, err := New(image("p3.jpg"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	// Converted to sRGB by default, like anything else.
+	thumb, err := img.Thumbnail(32, 32, true)
+	assert.Nil(t, err)
+	assert.Equal(t, profile(thumb, "icc"), "")
+	assert.InDelta(t, pixelColor(thumb, 16, 16)[0], 0.867, 0.03)
+
+	// Or kept, and labeled so browsers don't render it oversaturated.
+	img.WideGamut = true
+	thumb, err = img.Thumbnail(32, 32, true)
+	assert.Nil(t, err)
+	assert.Equal(t, profile(thumb, "icc"), compactDisplayP3)
+	assert.InDelta(t, pixelColor(thumb, 16, 16)[0], 0.8, 0.03)
+	assert.InDelta(t, pixelColor(thumb, 16, 16)[1], 0.3, 0.03)
+
+	// Unless saved in a format that can't be labeled, decided as it's saved.
+	result, err := img.Decode([]Operation{{Type: OpScale, Width: 32, Height: 32}})
+	assert.Nil(t, err)
+	defer result.Close()
+	gif, err := result.GetAs("GIF")
+	assert.Nil(t, err)
+	assert.InDelta(t, pixelColor(gif, 16, 16)[0], 0.867, 0.05)
+	thumb, err = result.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, profile(thumb, "icc"), compactDisplayP3)
+
+	// Narrower gamuts, like CMYK's, are still converted to sRGB.
+	img, err = New(image("cmyk-profile.jpg"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+	img.WideGamut = true
+	thumb, err = img.Thumbnail(32, 32, true)
+	assert.Nil(t, err)
+	assert.Equal(t, profile(thumb, "icc"), "")
+
+	assert.True(t, wideGamut(compactDisplayP3))
+	assert.False(t, wideGamut(compactSRGB))
+	assert.False(t, wideGamut(sRGB_IEC61966_2_1_black_scaled))
+}
+
+func profile(image []byte, name string) string {
+	wand := imagick.NewMagickWand()
+	defer wand.Destroy()
+	if err := wand.ReadImageBlob(image); err != nil {
+		return ""
+	}
+	return wand.GetImageProfile(name)
+}
+
+func TestImageFallbackFormats(t *testing.T) {
+	img, err := New(image("animated.gif"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	// A still from an animation takes the first fallback that fits.
+	img.FallbackFormats = []string{"WEBP", "PNG"}
+	thumb, err := img.Thumbnail(20, 20, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "WEBP", 13, 20))
+
+	// But an animation keeps its format.
+	img.AnimatedOutput = true
+	thumb, err = img.Thumbnail(20, 20, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isFrames(thumb, 3))
+	assert.Nil(t, isFormat(thumb, "GIF"))
+
+	img, err = New(image("alpha.png"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	// Alpha skips formats that can't hold it.
+	img.OutputFormat = "JPEG"
+	img.FallbackFormats = []string{"JPEG", "PNG"}
+	thumb, err = img.Thumbnail(16, 16, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isFormat(thumb, "PNG"))
+
+	// And without fallbacks, OutputFormat is used regardless.
+	img.FallbackFormats = nil
+	thumb, err = img.Thumbnail(16, 16, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isFormat(thumb, "JPEG"))
+}
+
+func TestImageAnimation(t *testing.T) {
+	img, err := New(image("animated.gif"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, img.Frames, uint(3))
+
+	// Verify that we keep just the first frame by default.
+	thumb, err := img.Thumbnail(20, 20, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isFrames(thumb, 1))
+
+	// Verify that we resize every frame when asked to.
+	img.AnimatedOutput = true
+	thumb, err = img.Thumbnail(20, 20, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "GIF", 13, 20))
+	assert.Nil(t, isFrames(thumb, 3))
+
+	// Verify that we truncate to the output format's limit.
+	img.MaxFrames = map[string]uint{"GIF": 2}
+	thumb, err = img.Thumbnail(20, 20, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isFrames(thumb, 2))
+
+	// Or refuse, if asked to.
+	img.TruncateFrames = false
+	_, err = img.Thumbnail(20, 20, true)
+	assert.Equal(t, err, TooManyFrames)
+}
+
+func TestImageMaxMemory(t *testing.T) {
+	img, err := New(image("flowers.png"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	// A still needs one frame of pixels.
+	img.MaxMemory = uint64(img.Width) * uint64(img.Height) * pixelBytes
+	_, err = img.Thumbnail(64, 64, true)
+	assert.Nil(t, err)
+
+	img.MaxMemory--
+	_, err = img.Thumbnail(64, 64, true)
+	assert.Equal(t, err, OverBudget)
+
+	img, err = New(image("animated.gif"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	// An animation needs a full canvas per frame, once coalesced.
+	img.AnimatedOutput = true
+	img.MaxMemory = uint64(img.Width) * uint64(img.Height) * uint64(img.Frames) * pixelBytes
+	_, err = img.Thumbnail(20, 20, true)
+	assert.Nil(t, err)
+
+	img.MaxMemory--
+	_, err = img.Thumbnail(20, 20, true)
+	assert.Equal(t, err, OverBudget)
+}
+
+func TestResultAutoCrop(t *testing.T) {
+	img, err := New(image("matte.png"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	// matte.png is a 20x32 blue box at 10,8 on white with faint speckles.
+	result, err := img.Decode(nil)
+	assert.Nil(t, err)
+	defer result.Close()
+	assert.Nil(t, result.AutoCrop(0.1, 0, 0))
+	assert.Equal(t, *result.Cropped, Region{X: 10, Y: 8, Width: 20, Height: 32})
+	assert.Equal(t, result.Width, uint(20))
+	assert.Equal(t, result.Height, uint(32))
+
+	// Padding to an aspect ratio centers the box, in the matte's color,
+	// and resizing afterward sees the new dimensions.
+	result, err = img.Decode(nil)
+	assert.Nil(t, err)
+	defer result.Close()
+	assert.Nil(t, result.AutoCrop(0.1, 1, 1))
+	assert.Equal(t, result.Width, uint(32))
+	assert.Equal(t, result.Height, uint(32))
+	assert.Nil(t, result.Resize(16, 16))
+	thumb, err := result.Get()
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "PNG", 16, 16))
+	assert.Nil(t, isDark(thumb, map[[2]int]bool{{1, 8}: false, {8, 1}: true, {8, 8}: true, {14, 8}: false}))
+	for _, c := range pixelColor(thumb, 0, 0) {
+		assert.InDelta(t, c, 1.0, 0.01)
+	}
+
+	// Without enough fuzz, the speckles count as content.
+	result, err = img.Decode(nil)
+	assert.Nil(t, err)
+	defer result.Close()
+	assert.Nil(t, result.AutoCrop(0, 0, 0))
+	assert.True(t, result.Width > 20)
+}
+
+func TestImageLanczosThreshold(t *testing.T) {
+	img, err := New(image("flowers.png"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	thumbnail := func(threshold float64, width, height uint) []byte {
+		img.LanczosThreshold = threshold
+		thumb, err := img.Thumbnail(width, height, true)
+		assert.Nil(t, err)
+		return thumb
+	}
+
+	// Shrinking a little uses Triangle, unless always asked for Lanczos.
+	w, h := img.Width-img.Width/100, img.Height-img.Height/100
+	assert.Equal(t, thumbnail(0.025, w, h), thumbnail(0.5, w, h))
+	assert.NotEqual(t, thumbnail(0.025, w, h), thumbnail(0, w, h))
+	assert.Equal(t, thumbnail(0, w, h), thumbnail(-1, w, h))
+
+	// Shrinking more than a threshold uses Lanczos.
+	w, h = img.Width/3, img.Height/3
+	assert.Equal(t, thumbnail(0.025, w, h), thumbnail(0, w, h))
+	assert.NotEqual(t, thumbnail(0.025, w, h), thumbnail(0.9, w, h))
+}
+
+func TestImageTrim(t *testing.T) {
+	img, err := New(image("matte.png"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	// The 20x32 box covers the square, once trimmed.
+	thumb, err := img.Process([]Operation{{Type: OpTrim, Width: 16, Height: 16}})
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "PNG", 16, 16))
+	assert.Nil(t, isDark(thumb, map[[2]int]bool{{0, 0}: true, {15, 15}: true}))
+
+	// Or fits within it, on the matte.
+	thumb, err = img.Process([]Operation{{Type: OpTrim, Width: 16, Height: 16, Pad: PadMatte}})
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "PNG", 16, 16))
+	assert.Nil(t, isDark(thumb, map[[2]int]bool{{1, 8}: false, {8, 1}: true, {8, 8}: true, {14, 8}: false}))
+}
+
+func TestImagePadBlur(t *testing.T) {
+	img, err := New(image("watermelon.jpg"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	// Letterboxed with a solid color.
+	thumb, err := img.Process([]Operation{{Type: OpScale, Width: 200, Height: 100, Pad: PadMatte}})
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "JPEG", 200, 100))
+	solid := pixelColor(thumb, 5, 50)
+	assert.True(t, solid[0] > 0.95 && solid[1] > 0.95 && solid[2] > 0.95, solid)
+
+	// Or with the image, blurred, around the sharp one.
+	blurred, err := img.Process([]Operation{{Type: OpScale, Width: 200, Height: 100, Pad: PadBlur}})
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(blurred, "JPEG", 200, 100))
+	assert.NotEqual(t, blurred, thumb)
+
+	// Already exactly the size, there's nothing to pad.
+	thumb, err = img.Process([]Operation{{Type: OpScale, Width: 149, Height: 200, Pad: PadBlur}})
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "JPEG", 149, 200))
+}
+
+func TestImageBrokenProfile(t *testing.T) {
+	img, err := New(image("badprofile.jpg"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	// A profile lcms can't parse is converted around by default.
+	thumb, err := img.Thumbnail(40, 40, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(thumb, "JPEG", 24, 40))
+
+	img.BrokenProfile = ProfileAssumeSRGB
+	srgb, err := img.Thumbnail(40, 40, true)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(srgb, "JPEG", 24, 40))
+
+	img.BrokenProfile = ProfileReject
+	_, err = img.Thumbnail(40, 40, true)
+	assert.Equal(t, err, BadProfile)
+
+	// Valid profiles are still applied.
+	img, err = New(image("orient1.jpg"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+	img.BrokenProfile = ProfileReject
+	_, err = img.Thumbnail(40, 40, true)
+	assert.Nil(t, err)
+}
+
+func TestImageAPNG(t *testing.T) {
+	img, err := New(image("animated.gif"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	img.OutputFormat = "PNG"
+	img.AnimatedOutput = true
+	thumb, err := img.Thumbnail(20, 20, true)
+	assert.Nil(t, err)
+	assert.True(t, bytes.HasPrefix(thumb, []byte("\x89PNG")))
+
+	// An animation control chunk makes it an APNG, where supported.
+	assert.Equal(t, bytes.Contains(thumb, []byte("acTL")), CanEncode("APNG"))
+}
+
+func TestImageMaxAnimationPixels(t *testing.T) {
+	img, err := New(image("animated.gif"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	pixels := uint64(img.Width) * uint64(img.Height) * uint64(img.Frames)
+	img.MaxAnimationPixels = pixels
+	_, err = img.Thumbnail(20, 20, true)
+	assert.Nil(t, err)
+
+	// Refused whether or not every frame would be kept.
+	img.MaxAnimationPixels = pixels - 1
+	_, err = img.Thumbnail(20, 20, true)
+	assert.Equal(t, err, AnimationTooBig)
+	img.AnimatedOutput = true
+	_, err = img.Thumbnail(20, 20, true)
+	assert.Equal(t, err, AnimationTooBig)
+
+	// Stills aren't animations.
+	img, err = New(image("flowers.png"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+	img.MaxAnimationPixels = 1
+	_, err = img.Thumbnail(20, 20, true)
+	assert.Nil(t, err)
+}
+
+func TestImageContactSheet(t *testing.T) {
+	img, err := New(image("animated.gif"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+
+	// Each frame fits in a 13x20 cell.
+	rows := (img.Frames + 1) / 2
+	sheet, err := img.ContactSheet(2, 20, 20)
+	assert.Nil(t, err)
+	assert.Nil(t, isFrames(sheet, 1))
+	assert.Nil(t, isSize(sheet, "GIF", 26, rows*20))
+
+	sheet, err = img.ContactSheet(0, 20, 20)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(sheet, "GIF", img.Frames*13, 20))
+
+	// A still is a sheet of one.
+	img, err = New(image("watermelon.jpg"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+	sheet, err = img.ContactSheet(4, 100, 100)
+	assert.Nil(t, err)
+	assert.Nil(t, isSize(sheet, "JPEG", 74, 100))
+
+	// Held to the same pixel limit as New.
+	img, err = New(image("animated.gif"), 10000000)
+	defer img.Close()
+	assert.Nil(t, err)
+	img, err = New(image("animated.gif"), img.Width*img.Height)
+	defer img.Close()
+	assert.Nil(t, err)
+	_, err = img.ContactSheet(0, img.Width, img.Height)
+	assert.Equal(t, err, TooBig)
+
+	// And its frames to a multiple of it, however small the sheet.
+	img.maxBufferPixels = img.Width*img.Height*img.Frames/contactSheetBuffers - 1
+	_, err = img.ContactSheet(0, 4, 4)
+	assert.Equal(t, err, TooBig)
+}
+
+func isFrames(image []byte, frames uint) error {
+	img, err := New(image, 10000000)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	if frames != img.Frames {
+		return fmt.Errorf("Frames %d!=%d", frames, img.Frames)
+	}
+	return nil
+}
+
+func isSize(image []byte, format string, width, height uint) error {
+	img, err := New(image, 10000000)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	if width != img.Width || height != img.Height {
+		return fmt.Errorf("Width %d!=%d or Height %d!=%d", width, img.Width, height, img.Height)
+	}
+	if format != img.InputFormat {
+		return fmt.Errorf("Format %s!=%s", format, img.InputFormat)
+	}
+	return nil
+}
+
+func isFormat(image []byte, format string) error {
+	img, err := New(image, 10000000)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
 	if format != img.InputFormat {
 		return fmt.Errorf("Format %s!=%s", format, img.InputFormat)
 	}
@@ -0,0 +1,84 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package imager
+
+import (
+	"bytes"
+)
+
+const (
+	tagMPEntry = 0xb002 // Array of 16-byte MP Entries, one per image.
+
+	mpRepresentative = 1 << 29  // Attribute flag for the image to display.
+	mpTypeMask       = 0xffffff // Attribute bits for the MP Type Code.
+	mpTypePrimary    = 0x030000 // MP Type Code of a Baseline MP Primary Image.
+)
+
+// mpfPrimary returns the full-resolution primary image of a JPEG in
+// Multi-Picture Format, which cameras use to store previews, stereo pairs,
+// and so on alongside it.  ImageMagick only decodes the first image in the
+// file, which isn't necessarily the primary.  Returns blob if it isn't MPF,
+// or if it's malformed.
+func mpfPrimary(blob []byte) []byte {
+	// Offsets are relative to the MP header, which is a TIFF header.
+	start := jpegSegmentOffset(blob, 0xe2, []byte("MPF\x00"))
+	if start < 0 {
+		return blob
+	}
+	mp := jpegSegment(blob, 0xe2, []byte("MPF\x00"))
+	order := tiffByteOrder(mp)
+	if order == nil {
+		return blob
+	}
+
+	entries := ifdEntries(mp, order, order.Uint32(mp[4:]))
+
+	var list []byte
+	for i := 0; i+12 <= len(entries); i += 12 {
+		entry := entries[i : i+12]
+		if order.Uint16(entry) != tagMPEntry || order.Uint16(entry[2:]) != 7 {
+			continue
+		}
+
+		// MP Entries never fit in the 4 bytes of the tag value,
+		// so it's always an offset.
+		count, offset := uint64(order.Uint32(entry[4:])), uint64(order.Uint32(entry[8:]))
+		if count < 16 || offset+count > uint64(len(mp)) {
+			return blob
+		}
+		list = mp[offset : offset+count]
+	}
+
+	// Prefer the image flagged as representative, else the first primary.
+	best := -1
+	for i := 0; i+16 <= len(list); i += 16 {
+		attr := order.Uint32(list[i:])
+		if attr&mpRepresentative != 0 {
+			best = i
+			break
+		}
+		if best < 0 && attr&mpTypeMask == mpTypePrimary {
+			best = i
+		}
+	}
+
+	// The first image is the one ImageMagick would decode anyway, and
+	// always has an offset of 0.
+	if best <= 0 {
+		return blob
+	}
+
+	size, offset := uint64(order.Uint32(list[best+4:])), uint64(order.Uint32(list[best+8:]))
+	if offset == 0 || uint64(start)+offset+size > uint64(len(blob)) {
+		return blob
+	}
+
+	primary := blob[uint64(start)+offset : uint64(start)+offset+size]
+	if !bytes.HasPrefix(primary, []byte{0xff, 0xd8}) {
+		return blob
+	}
+
+	return primary
+}
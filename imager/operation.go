@@ -0,0 +1,80 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package imager
+
+// OperationType selects what an Operation does to a Result.
+type OperationType int
+
+const (
+	OpScale       OperationType = iota // Scale to fit within Width x Height.
+	OpCrop                             // Scale to cover Width x Height, then crop the overflow.
+	OpRotate                           // Rotate clockwise by Degrees, leaving the size to fit.
+	OpAspect                           // Crop to the aspect ratio Width:Height, keeping as much as possible.
+	OpDownscale                        // Scale to fit within Width x Height, but never enlarge.
+	OpFill                             // Like OpCrop, but keep the part selected by Gravity.
+	OpTrim                             // Crop away a matte, then like OpCrop, or if Pad, pad to fit Width x Height.
+	OpCropPercent                      // Crop to Width x Height percent of the image, keeping the part selected by Gravity.
+)
+
+// An Operation is one step of a chain of transformations applied to a Result.
+type Operation struct {
+	Type    OperationType
+	Width   uint
+	Height  uint
+	Degrees float64 // For OpRotate.
+	Gravity Gravity // For OpFill and OpCropPercent.
+	Pad     PadMode // For OpScale and OpTrim.
+}
+
+// PadMode selects how an OpScale or OpTrim fills out Width x Height around
+// an image that fits within it.
+type PadMode int
+
+const (
+	PadNone  PadMode = iota // Don't pad, leaving the image smaller.
+	PadMatte                // With the trimmed matte, or for OpScale, BackgroundColor.
+	PadBlur                 // With the image itself, scaled to cover and heavily blurred.
+)
+
+// scaled returns the size that an image of width x height is scaled to by op,
+// before any cropping.  How far OpTrim scales depends on what it trims, so
+// it's as if unscaled.
+func (op Operation) scaled(width, height uint) (uint, uint) {
+	if op.Type == OpRotate || op.Type == OpAspect || op.Type == OpTrim || op.Type == OpCropPercent {
+		return width, height
+	}
+	if op.Type == OpDownscale && width <= op.Width && height <= op.Height {
+		return width, height
+	}
+	return scaleAspect(width, height, op.Width, op.Height, !op.crops())
+}
+
+// crops reports whether op scales to cover its size, then crops to it.
+func (op Operation) crops() bool {
+	return op.Type == OpCrop || op.Type == OpFill
+}
+
+// Unchanged reports whether ops would leave img as it is, so the original
+// could be served instead, metadata and all: when every operation is an
+// OpDownscale that it already fits, it needs no orientation fix,
+// downscaling on decode or border, and it would be saved in the same format.
+func (img *Imager) Unchanged(ops []Operation) bool {
+	if img.InputFormat != img.OutputFormat || img.Orientation.fn != nil || img.downscaled || img.BorderWidth > 0 {
+		return false
+	}
+
+	// A still from an animation is never the original.
+	if img.Frames > 1 && !img.AnimatedOutput {
+		return false
+	}
+
+	for _, op := range ops {
+		if op.Type != OpDownscale || img.Width > op.Width || img.Height > op.Height {
+			return false
+		}
+	}
+
+	return true
+}
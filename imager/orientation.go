@@ -9,6 +9,7 @@ import (
 )
 
 type Orientation struct {
+	tag    imagick.OrientationType
 	swapXY bool
 	flipX  bool
 	flipY  bool
@@ -18,28 +19,28 @@ type Orientation struct {
 func NewOrientation(orientation imagick.OrientationType) *Orientation {
 	switch orientation {
 	default:
-		return &Orientation{swapXY: false, flipX: false, flipY: false,
+		return &Orientation{tag: orientation, swapXY: false, flipX: false, flipY: false,
 			fn: nil}
 	case imagick.ORIENTATION_TOP_RIGHT:
-		return &Orientation{swapXY: false, flipX: true, flipY: false,
+		return &Orientation{tag: orientation, swapXY: false, flipX: true, flipY: false,
 			fn: func(wand *imagick.MagickWand) error { return wand.FlopImage() }}
 	case imagick.ORIENTATION_BOTTOM_RIGHT:
-		return &Orientation{swapXY: false, flipX: true, flipY: true,
+		return &Orientation{tag: orientation, swapXY: false, flipX: true, flipY: true,
 			fn: func(wand *imagick.MagickWand) error { return wand.RotateImage(white, 180.0) }}
 	case imagick.ORIENTATION_BOTTOM_LEFT:
-		return &Orientation{swapXY: false, flipX: false, flipY: true,
+		return &Orientation{tag: orientation, swapXY: false, flipX: false, flipY: true,
 			fn: func(wand *imagick.MagickWand) error { return wand.FlipImage() }}
 	case imagick.ORIENTATION_LEFT_TOP:
-		return &Orientation{swapXY: true, flipX: false, flipY: false,
+		return &Orientation{tag: orientation, swapXY: true, flipX: false, flipY: false,
 			fn: func(wand *imagick.MagickWand) error { return wand.TransposeImage() }}
 	case imagick.ORIENTATION_RIGHT_TOP:
-		return &Orientation{swapXY: true, flipX: false, flipY: true,
+		return &Orientation{tag: orientation, swapXY: true, flipX: false, flipY: true,
 			fn: func(wand *imagick.MagickWand) error { return wand.RotateImage(white, 90.0) }}
 	case imagick.ORIENTATION_RIGHT_BOTTOM:
-		return &Orientation{swapXY: true, flipX: true, flipY: true,
+		return &Orientation{tag: orientation, swapXY: true, flipX: true, flipY: true,
 			fn: func(wand *imagick.MagickWand) error { return wand.TransverseImage() }}
 	case imagick.ORIENTATION_LEFT_BOTTOM:
-		return &Orientation{swapXY: true, flipX: true, flipY: false,
+		return &Orientation{tag: orientation, swapXY: true, flipX: true, flipY: false,
 			fn: func(wand *imagick.MagickWand) error { return wand.RotateImage(white, 270.0) }}
 	}
 }
@@ -77,6 +78,13 @@ func (orientation *Orientation) Fix(wand *imagick.MagickWand) error {
 		return err
 	}
 
-	*orientation = Orientation{swapXY: false, flipX: false, flipY: false, fn: nil}
+	*orientation = Orientation{tag: orientation.tag, swapXY: false, flipX: false, flipY: false, fn: nil}
 	return nil
 }
+
+// Tag returns the EXIF orientation the image was tagged with, from 1 to 8,
+// or 0 if untagged, even once Fix has corrected it.  Pipelines that rotate
+// pixels without resetting the tag show up as mismatches here.
+func (orientation *Orientation) Tag() uint {
+	return uint(orientation.tag)
+}
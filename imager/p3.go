@@ -0,0 +1,45 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package imager
+
+import (
+	"encoding/binary"
+)
+
+// compactDisplayP3 is a 588-byte Display P3 profile, the wide gamut of
+// recent phones and laptops, for tagging output that keeps it.  It's
+// compactSRGB with Display P3's D50-adapted primaries, as both share the
+// sRGB tone curve.
+const compactDisplayP3 = "\x00\x00\x02\x4c\x00\x00\x00\x00\x02\x10\x00\x00\x6d\x6e\x74\x72\x52\x47\x42\x20\x58\x59\x5a\x20\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x61\x63\x73\x70\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xf6\xd6\x00\x01\x00\x00\x00\x00\xd3\x2d\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x09\x64\x65\x73\x63\x00\x00\x00\xf0\x00\x00\x00\x65\x63\x70\x72\x74\x00\x00\x01\x58\x00\x00\x00\x16\x77\x74\x70\x74\x00\x00\x01\x70\x00\x00\x00\x14\x72\x58\x59\x5a\x00\x00\x01\x84\x00\x00\x00\x14\x67\x58\x59\x5a\x00\x00\x01\x98\x00\x00\x00\x14\x62\x58\x59\x5a\x00\x00\x01\xac\x00\x00\x00\x14\x72\x54\x52\x43\x00\x00\x01\xc0\x00\x00\x00\x8c\x67\x54\x52\x43\x00\x00\x01\xc0\x00\x00\x00\x8c\x62\x54\x52\x43\x00\x00\x01\xc0\x00\x00\x00\x8c\x64\x65\x73\x63\x00\x00\x00\x00\x00\x00\x00\x0b\x44\x69\x73\x70\x6c\x61\x79\x20\x50\x33\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x74\x65\x78\x74\x00\x00\x00\x00\x50\x75\x62\x6c\x69\x63\x20\x44\x6f\x6d\x61\x69\x6e\x00\x00\x00\x58\x59\x5a\x20\x00\x00\x00\x00\x00\x00\xf6\xd6\x00\x01\x00\x00\x00\x00\xd3\x2d\x58\x59\x5a\x20\x00\x00\x00\x00\x00\x00\x83\xdf\x00\x00\x3d\xbf\xff\xff\xff\xbb\x58\x59\x5a\x20\x00\x00\x00\x00\x00\x00\x4a\xbf\x00\x00\xb1\x37\x00\x00\x0a\xb9\x58\x59\x5a\x20\x00\x00\x00\x00\x00\x00\x28\x38\x00\x00\x11\x0b\x00\x00\xc8\xb9\x63\x75\x72\x76\x00\x00\x00\x00\x00\x00\x00\x40\x00\x00\x00\x51\x00\xa1\x00\xf4\x01\x59\x01\xd2\x02\x61\x03\x08\x03\xc5\x04\x9c\x05\x8c\x06\x97\x07\xbc\x08\xfd\x0a\x5b\x0b\xd6\x0d\x6f\x0f\x27\x10\xfd\x12\xf3\x15\x0a\x17\x41\x19\x9a\x1c\x15\x1e\xb2\x21\x72\x24\x56\x27\x5e\x2a\x8a\x2d\xdb\x31\x52\x34\xef\x38\xb1\x3c\x9b\x40\xac\x44\xe4\x49\x45\x4d\xce\x52\x80\x57\x5b\x5c\x60\x61\x8e\x66\xe8\x6c\x6c\x72\x1b\x77\xf6\x7d\xfd\x84\x30\x8a\x8f\x91\x1c\x97\xd6\x9e\xbe\xa5\xd4\xad\x18\xb4\x8b\xbc\x2d\xc3\xfe\xcb\xff\xd4\x30\xdc\x91\xe5\x23\xed\xe5\xf6\xd9\xff\xff"
+
+// wideGamut reports whether an RGB profile's red primary lies beyond
+// sRGB's, as Display P3's, Adobe RGB's and ProPhoto's do.  Profiles
+// without matrix primaries, like CMYK's, aren't considered wide.
+func wideGamut(icc string) bool {
+	if len(icc) < 132 {
+		return false
+	}
+
+	tags := binary.BigEndian.Uint32([]byte(icc[128:132]))
+	for i := 0; i < int(tags) && 144+12*i <= len(icc); i++ {
+		entry := []byte(icc[132+12*i : 144+12*i])
+		if string(entry[0:4]) != "rXYZ" {
+			continue
+		}
+
+		// An XYZ type, then X, Y and Z as s15Fixed16 numbers.
+		offset := int(binary.BigEndian.Uint32(entry[4:8]))
+		if offset < 0 || offset+12 > len(icc) || icc[offset:offset+4] != "XYZ " {
+			return false
+		}
+		x := float64(int32(binary.BigEndian.Uint32([]byte(icc[offset+8:offset+12])))) / 65536
+
+		// sRGB's red has an X of 0.436, and Display P3's, the narrowest
+		// wide gamut, 0.515.
+		return x > 0.46
+	}
+
+	return false
+}
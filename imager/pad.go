@@ -0,0 +1,112 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package imager
+
+import (
+	"github.com/gographics/imagick/imagick"
+)
+
+const (
+	// How heavily PadBlur blurs its background, relative to its longer side.
+	padBlurFactor = 0.04
+
+	// Longer side of the copy PadBlur blurs before enlarging it, so the
+	// blur costs the same however large the output.
+	padBlurSize = 32
+)
+
+// padScaled fills out the image to width x height, if that's larger, as
+// mode asks: with img.BackgroundColor, or with a blurred copy of itself.
+func (result *Result) padScaled(width, height uint, mode PadMode) error {
+	if width <= result.Width && height <= result.Height {
+		return nil
+	}
+
+	// Pad around what the viewer sees.
+	if err := result.Orientation.Fix(result.wand); err != nil {
+		return err
+	}
+
+	// A colored background needs color channels to go in.
+	if err := result.promote(); err != nil {
+		return err
+	}
+
+	if mode == PadBlur {
+		return result.padBlur(width, height)
+	}
+
+	background := imagick.NewPixelWand()
+	defer background.Destroy()
+	if !background.SetColor(result.img.BackgroundColor) {
+		return BadColor
+	}
+
+	return result.pad(width, height, background)
+}
+
+// padBlur centers the upright image on a copy of itself, scaled to cover
+// width x height and blurred, so letterboxing looks like the image rather
+// than bars.  The copy is blurred at no more than padBlurSize, then
+// smoothly enlarged, which blurs it further for free.
+func (result *Result) padBlur(width, height uint) error {
+	background := result.Clone()
+
+	bw, bh := width, height
+	if bw > padBlurSize || bh > padBlurSize {
+		bw, bh = scaleAspect(width, height, padBlurSize, padBlurSize, true)
+		if bw == 0 {
+			bw = 1
+		}
+		if bh == 0 {
+			bh = 1
+		}
+	}
+
+	w, h := scaleAspect(result.Width, result.Height, bw, bh, false)
+	if err := background.Resize(w, h); err != nil {
+		background.Close()
+		return err
+	}
+	if err := background.Crop(bw, bh); err != nil {
+		background.Close()
+		return err
+	}
+
+	longer := bw
+	if bh > longer {
+		longer = bh
+	}
+	sigma := padBlurFactor * float64(longer)
+	err := background.each(func() error {
+		if err := background.wand.GaussianBlurImage(0, sigma); err != nil {
+			return err
+		}
+		return background.wand.ResizeImage(width, height, imagick.FILTER_TRIANGLE, 1)
+	})
+	if err != nil {
+		background.Close()
+		return err
+	}
+
+	x, y := GravityCenter.offset(width, height, result.Width, result.Height)
+	for i := 0; i < int(result.wand.GetNumberImages()); i++ {
+		result.wand.SetIteratorIndex(i)
+		background.wand.SetIteratorIndex(i)
+		if err := background.wand.CompositeImage(result.wand, imagick.COMPOSITE_OP_OVER, x, y); err != nil {
+			background.Close()
+			return err
+		}
+	}
+	background.wand.ResetIterator()
+
+	result.wand.Destroy()
+	result.wand = background.wand
+	result.Width = width
+	result.Height = height
+	result.transformed = true
+
+	return nil
+}
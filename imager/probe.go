@@ -0,0 +1,46 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package imager
+
+// Info describes an image without decoding it.
+type Info struct {
+	Width       uint // After orientation is fixed.
+	Height      uint
+	Format      string
+	HasAlpha    bool
+	IsAnimated  bool
+	Orientation uint // EXIF orientation tag, from 1 to 8, or 0 if untagged.
+}
+
+// Probe reads just enough of blob's headers to describe it, which is far
+// cheaper than New for large images.  It refuses the same formats as New,
+// but leaves enforcing size limits to the caller.
+func Probe(blob []byte) (*Info, error) {
+	format, _ := detectFormats(blob)
+	if format == "" || !CanDecode(format) {
+		return nil, UnknownFormat
+	}
+
+	if format == "JPEG" {
+		blob = mpfPrimary(blob)
+	}
+
+	info, _, _, err := imageMetaData(blob, format)
+	if err != nil {
+		return nil, Truncated
+	}
+
+	if info.Format != format {
+		return nil, UnknownFormat
+	}
+
+	if format == "WEBP" {
+		alpha, animated := webpFeatures(blob)
+		info.HasAlpha = info.HasAlpha || alpha
+		info.IsAnimated = info.IsAnimated || animated
+	}
+
+	return info, nil
+}
@@ -7,6 +7,8 @@ package imager
 import (
 	"fmt"
 	"github.com/gographics/imagick/imagick"
+	"math"
+	"strconv"
 )
 
 type Result struct {
@@ -15,14 +17,48 @@ type Result struct {
 	Width       uint
 	Height      uint
 	Orientation Orientation
+	Cropped     *Region // The area the last Crop kept, upright, in the image as it was; nil = none.
 	shrank      bool
+	scale       float64 // Output size relative to the original, across all resizes.
+	format      string  // Output format, usually img.OutputFormat.
+	sampling    string  // A JPEG source's chroma subsampling, like "2x2,1x1,1x1".
+	transformed bool    // Whether Resize or Crop has been called.
+	animated    bool    // Whether every frame is processed and saved.
+	gray        bool    // Whether pixels are still single-channel grayscale.
+	p3          bool    // Whether pixels are Display P3, rather than sRGB.
+}
+
+// A Region is a rectangle within an image, from its top left corner.
+type Region struct {
+	X, Y          int
+	Width, Height uint
 }
 
 func (img *Imager) NewResult(width, height uint) (*Result, error) {
+	return img.newResult(width, height, false)
+}
+
+// newResult is NewResult, keeping every frame of an animation regardless
+// of img.AnimatedOutput if allFrames is set.
+func (img *Imager) newResult(width, height uint, allFrames bool) (*Result, error) {
 	result := &Result{
 		Orientation: *img.Orientation,
 		img:         img,
 		wand:        imagick.NewMagickWand(),
+		format:      img.OutputFormat,
+	}
+
+	// An image New downscaled must pre-scale at least that much.
+	if img.downscaled && (width == 0 || height == 0 || width > img.Width || height > img.Height) {
+		width, height = img.Width, img.Height
+	}
+
+	// Security: Refuse before decoding if even the decoder's best
+	// pre-scaling would leave more pixels than New allowed, as a decode at
+	// full size would for anything but a JPEG scaled down on the way in.
+	if img.decodedPixels(width, height) > uint64(img.maxBufferPixels) {
+		result.Close()
+		return nil, TooBig
 	}
 
 	// Swap width and height if orientation will be corrected later.
@@ -38,8 +74,53 @@ func (img *Imager) NewResult(width, height uint) (*Result, error) {
 		}
 	}
 
+	// Security: Refuse animations whose headers already say they'd decode
+	// to too many pixels, before decoding any.
+	if img.MaxAnimationPixels > 0 && img.Frames > 1 && uint64(img.Width)*uint64(img.Height)*uint64(img.Frames) > img.MaxAnimationPixels {
+		result.Close()
+		return nil, AnimationTooBig
+	}
+
+	// Security: Decode with the detected format's decoder only.
+	if err := result.wand.SetFormat(img.InputFormat); err != nil {
+		result.Close()
+		return nil, err
+	}
+
 	// Decompress the image into a pixel buffer, possibly pre-scaling first.
+	// ImageMagick reports truncated data as an error, but usually still
+	// decodes what it can, which BestEffort accepts.
 	if err := result.wand.ReadImageBlob(img.blob); err != nil {
+		if !img.BestEffort || result.wand.GetNumberImages() == 0 {
+			result.Close()
+			return nil, Truncated
+		}
+	}
+
+	// Headers can understate what an image costs, like an animation with
+	// frames larger than its canvas, so check what was actually decoded.
+	if err := result.withinBudget(); err != nil {
+		result.Close()
+		return nil, err
+	}
+
+	if img.InputFormat == "JPEG" {
+		result.sampling = result.wand.GetImageProperty("jpeg:sampling-factor")
+	}
+
+	// Keep every frame if we can save an animation.
+	if (allFrames || img.AnimatedOutput && canAnimate(result.format)) && result.wand.GetNumberImages() > 1 {
+		if err := result.coalesce(); err != nil {
+			result.Close()
+			return nil, err
+		}
+	} else if err := result.still(); err != nil {
+		result.Close()
+		return nil, err
+	}
+
+	// Coalescing expands every frame to the full canvas.
+	if err := result.withinBudget(); err != nil {
 		result.Close()
 		return nil, err
 	}
@@ -47,38 +128,35 @@ func (img *Imager) NewResult(width, height uint) (*Result, error) {
 	// Make sure that we are using the first frame of an animation.
 	result.wand.ResetIterator()
 
-	// Reset virtual canvas and position.
-	if err := result.wand.ResetImagePage(""); err != nil {
+	if err := result.each(result.toSRGB); err != nil {
 		result.Close()
 		return nil, err
 	}
 
-	if result.applyColorProfile() {
-		// Make sure ImageMagick is aware that this is now sRGB.
-		if err := result.wand.SetColorspace(imagick.COLORSPACE_SRGB); err != nil {
-			result.Close()
-			return nil, err
-		}
-	} else if result.wand.GetImageColorspace() != imagick.COLORSPACE_SRGB {
-		// Switch to sRGB colorspace, the default for the web.
-		if err := result.wand.TransformImageColorspace(imagick.COLORSPACE_SRGB); err != nil {
+	// These may be smaller than img.Width and img.Height if JPEG decoder pre-scaled image.
+	result.Width, result.Height = result.Orientation.Dimensions(result.wand.GetImageWidth(), result.wand.GetImageHeight())
+
+	// Or larger, if it was too big to decode at the size New reported.
+	if result.Width > img.Width || result.Height > img.Height {
+		ow, oh := result.Orientation.Dimensions(img.Width, img.Height)
+		if err := result.each(func() error { return result.wand.ResizeImage(ow, oh, imagick.FILTER_LANCZOS, 1) }); err != nil {
 			result.Close()
 			return nil, err
 		}
+		result.Width, result.Height = img.Width, img.Height
 	}
 
-	// These may be smaller than img.Width and img.Height if JPEG decoder pre-scaled image.
-	result.Width, result.Height = result.Orientation.Dimensions(result.wand.GetImageWidth(), result.wand.GetImageHeight())
-
 	if result.Width < img.Width && result.Height < img.Height {
 		result.shrank = true
 	}
+	result.scale = float64(result.Width) / float64(img.Width)
 
 	// If the image has shrunk or will shrink, apply requested blur.
-	if img.BlurFactor > 0 && width > 0 && img.Width > width && height > 0 && img.Height > height {
+	// Blurring this larger image is slower than blurring the output.
+	if img.BlurFactor > 0 && !img.BlurAfterResize && width > 0 && img.Width > width && height > 0 && img.Height > height {
 		// Radius is ratio of current dimension to output dimension.
 		radius := float64(result.Width) / float64(width)
-		if err := result.wand.GaussianBlurImage(0, result.img.BlurFactor*radius); err != nil {
+		if err := result.each(func() error { return result.wand.GaussianBlurImage(0, result.img.BlurFactor*radius) }); err != nil {
 			return nil, err
 		}
 	}
@@ -86,124 +164,824 @@ func (img *Imager) NewResult(width, height uint) (*Result, error) {
 	return result, nil
 }
 
-func (result *Result) applyColorProfile() bool {
+// ImageMagick's pixels hold four 16-bit channels.
+const pixelBytes = 8
+
+// withinBudget returns OverBudget if the decoded frames' pixels take more
+// than img.MaxMemory bytes, or AnimationTooBig if there's more than one and
+// they add up to more than img.MaxAnimationPixels.
+func (result *Result) withinBudget() error {
+	if result.img.MaxMemory == 0 && result.img.MaxAnimationPixels == 0 {
+		return nil
+	}
+
+	frames := result.wand.GetNumberImages()
+	var pixels uint64
+	for i := uint(0); i < frames; i++ {
+		result.wand.SetIteratorIndex(int(i))
+		pixels += uint64(result.wand.GetImageWidth()) * uint64(result.wand.GetImageHeight())
+		if result.img.MaxMemory > 0 && pixels*pixelBytes > result.img.MaxMemory {
+			return OverBudget
+		}
+		if result.img.MaxAnimationPixels > 0 && frames > 1 && pixels > result.img.MaxAnimationPixels {
+			return AnimationTooBig
+		}
+	}
+
+	return nil
+}
+
+func (result *Result) toSRGB() error {
+	// Reset virtual canvas and position.
+	if err := result.wand.ResetImagePage(""); err != nil {
+		return err
+	}
+
+	applied, err := result.applyColorProfile()
+	if err != nil {
+		return err
+	}
+
+	if applied {
+		// Make sure ImageMagick is aware that this is now sRGB.
+		return result.wand.SetColorspace(imagick.COLORSPACE_SRGB)
+	} else if result.img.KeepGrayscale && result.wand.GetImageColorspace() == imagick.COLORSPACE_GRAY {
+		// Gray is already sRGB's gray, and promoting it would only triple
+		// the data to compress.
+		result.gray = true
+		return nil
+	} else if result.wand.GetImageColorspace() != imagick.COLORSPACE_SRGB {
+		// Switch to sRGB colorspace, the default for the web.
+		return result.wand.TransformImageColorspace(imagick.COLORSPACE_SRGB)
+	}
+
+	return nil
+}
+
+// promote converts grayscale pixels to sRGB, before color is added to them.
+func (result *Result) promote() error {
+	if !result.gray {
+		return nil
+	}
+
+	if err := result.each(func() error { return result.wand.TransformImageColorspace(imagick.COLORSPACE_SRGB) }); err != nil {
+		return err
+	}
+
+	result.gray = false
+	return nil
+}
+
+// applyColorProfile converts the image to sRGB, or Display P3, from its
+// color profile, reporting whether it could.  A profile that can't be
+// applied is handled as img.BrokenProfile says.
+func (result *Result) applyColorProfile() (bool, error) {
 	icc := result.wand.GetImageProfile("icc")
-	if icc == "" {
-		return false // no color profile
+	embedded := icc != ""
+	if !embedded {
+		assumed := result.assumedProfile()
+		if assumed == nil {
+			return false, nil // no color profile
+		}
+
+		// Tag untagged images with the assumed profile, so they're converted from that.
+		if err := result.wand.SetImageProfile("icc", assumed); err != nil {
+			return false, nil
+		}
+		icc = string(assumed)
+	}
+
+	// Keep colors sRGB can't show, if asked.  Get converts them after all
+	// if the format it saves in can't say so.
+	target := sRGB_IEC61966_2_1_black_scaled
+	if result.img.WideGamut && wideGamut(icc) {
+		target = compactDisplayP3
 	}
 
-	if icc == sRGB_IEC61966_2_1_black_scaled {
-		return true // already applied
+	if icc == target {
+		result.p3 = target == compactDisplayP3
+		return true, nil // already applied
 	}
 
-	// Apply sRGB IEC 61966 2.1 to this image.
-	err := result.wand.ProfileImage("icc", []byte(sRGB_IEC61966_2_1_black_scaled))
-	return err == nil // did we successfully apply?
+	// Apply sRGB IEC 61966 2.1 to this image.  This converts from the
+	// embedded profile, whatever its color space, so CMYK is converted
+	// as calibrated rather than by ImageMagick's naive CMYK to RGB.
+	if err := result.wand.ProfileImage("icc", []byte(target)); err != nil {
+		if !embedded {
+			return false, nil
+		}
+		return result.brokenProfile()
+	}
+	result.p3 = target == compactDisplayP3
+	return true, nil
+}
+
+// brokenProfile handles an embedded profile that couldn't be applied,
+// as applyColorProfile.
+func (result *Result) brokenProfile() (bool, error) {
+	if result.img.BrokenProfile == ProfileReject {
+		return false, BadProfile
+	}
+
+	result.wand.RemoveImageProfile("icc")
+	if result.img.BrokenProfile == ProfileAssumeSRGB {
+		return false, nil
+	}
+	return result.applyColorProfile()
+}
+
+// assumedProfile returns the profile to assume for an untagged image, or nil.
+func (result *Result) assumedProfile() []byte {
+	switch result.wand.GetImageColorspace() {
+	case imagick.COLORSPACE_SRGB:
+		return result.img.AssumeProfile
+	case imagick.COLORSPACE_CMYK:
+		return result.img.AssumeCMYKProfile
+	default:
+		return nil
+	}
 }
 
 func (result *Result) Resize(width, height uint) error {
-	// Only use Lanczos if we are shrinking by more than 2.5%.
+	// Only sharpen if we are shrinking by more than 2.5%.
+	shrinking := width < result.Width-result.Width/40 && height < result.Height-result.Height/40
+
+	// Lanczos is sharper but slower, so only use it if shrinking by more
+	// than img.LanczosThreshold.
 	filter := imagick.FILTER_TRIANGLE
-	shrinking := false
-	if width < result.Width-result.Width/40 && height < result.Height-result.Height/40 {
+	threshold := result.img.LanczosThreshold
+	if result.img.PixelArt && width > result.Width {
+		filter = imagick.FILTER_POINT
+	} else if threshold < 0 || (width < result.Width-uint(float64(result.Width)*threshold) && height < result.Height-uint(float64(result.Height)*threshold)) {
 		filter = imagick.FILTER_LANCZOS
-		shrinking = true
 	}
 
 	ow, oh := result.Orientation.Dimensions(width, height)
-	if err := result.wand.ResizeImage(ow, oh, filter, 1); err != nil {
+	if err := result.each(func() error { return result.wand.ResizeImage(ow, oh, filter, 1) }); err != nil {
 		return err
 	}
 
 	// Only change dimensions and/or set shrank flag on success.
+	result.scale *= float64(width) / float64(result.Width)
 	result.Width = width
 	result.Height = height
 	result.shrank = shrinking
+	result.transformed = true
 
 	return nil
 }
 
+// pixelScaled returns the whole multiple of the result's size nearest
+// width x height: the largest within it, or if cover is set, the
+// smallest covering it, for cropping.
+func (result *Result) pixelScaled(width, height uint, cover bool) (uint, uint) {
+	n, nh := width/result.Width, height/result.Height
+	if cover {
+		if width%result.Width != 0 {
+			n++
+		}
+		if height%result.Height != 0 {
+			nh++
+		}
+		if nh > n {
+			n = nh
+		}
+	} else if nh < n {
+		n = nh
+	}
+
+	if n < 1 {
+		n = 1
+	}
+	return result.Width * n, result.Height * n
+}
+
 func (result *Result) Crop(width, height uint) error {
+	return result.CropGravity(width, height, GravityCenter)
+}
 
-	// Center horizontally
-	x := (int(result.Width) - int(width) + 1) / 2
-	// Also center vertically
-	y := (int(result.Height) - int(height) + 1) / 2
+// CropGravity is Crop, keeping the part of the image selected by gravity
+// rather than the center.
+func (result *Result) CropGravity(width, height uint, gravity Gravity) error {
+	x, y := gravity.offset(result.Width, result.Height, width, height)
 
 	ow, oh, ox, oy := result.Orientation.Crop(width, height, x, y, result.Width, result.Height)
-	if err := result.wand.CropImage(ow, oh, ox, oy); err != nil {
+	if err := result.each(func() error { return result.cropFrame(ow, oh, ox, oy) }); err != nil {
 		return err
 	}
 
+	result.Cropped = &Region{X: x, Y: y, Width: width, Height: height}
 	result.Width = width
 	result.Height = height
+	result.transformed = true
+
+	return nil
+}
+
+func (result *Result) cropFrame(width, height uint, x, y int) error {
+	if err := result.wand.CropImage(width, height, x, y); err != nil {
+		return err
+	}
+
+	// Animation frames would otherwise keep their offsets in the canvas.
+	if result.animated {
+		return result.wand.ResetImagePage("")
+	}
+
+	return nil
+}
+
+// decodedPixels is how many pixels decoding at width x height leaves: the
+// full image, unless the JPEG decoder can pre-scale it.
+func (img *Imager) decodedPixels(width, height uint) uint64 {
+	eighths := uint(8)
+	if img.InputFormat == "JPEG" {
+		eighths = jpegEighths(img.fullWidth, img.fullHeight, width, height)
+	}
+
+	return uint64(jpegScaled(img.fullWidth, eighths)) * uint64(jpegScaled(img.fullHeight, eighths))
+}
+
+// jpegEighths is the scale, in eighths, that "jpeg:size" has the JPEG
+// decoder shrink a fullWidth x fullHeight image by when asked for at least
+// width x height.  ImageMagick divides by the whole ratio between them,
+// which libjpeg rounds up to a multiple of 1/8, and that in practice is
+// 1/2, 1/4 or 1/8, so we assume only those.
+func jpegEighths(fullWidth, fullHeight, width, height uint) uint {
+	if width == 0 || height == 0 || width >= fullWidth || height >= fullHeight {
+		return 8
+	}
+
+	ratio := fullWidth / width
+	if r := fullHeight / height; r < ratio {
+		ratio = r
+	}
+
+	eighths := uint(8)
+	for eighths > 1 && eighths/2*ratio >= 8 {
+		eighths /= 2
+	}
+	return eighths
+}
+
+// jpegScaled is how large the JPEG decoder leaves a side of full pixels
+// scaled by eighths.
+func jpegScaled(full, eighths uint) uint {
+	return (full*eighths + 7) / 8
+}
+
+// Apply performs op on the result, updating its dimensions.  Fails with
+// TooBig if that leaves frames with more pixels than New allowed, so a
+// chain of operations can't enlarge an image past the limit a step at a
+// time.  Resizes are refused before they allocate.  Totals across the
+// frames of an animation are left to MaxAnimationPixels.
+func (result *Result) Apply(op Operation) error {
+	if op.Type != OpRotate && op.Type != OpAspect && op.Type != OpTrim && op.Type != OpCropPercent {
+		_, width, height, err := result.target(op)
+		if err != nil {
+			return err
+		}
+		if uint64(width)*uint64(height) > uint64(result.img.maxBufferPixels) {
+			return TooBig
+		}
+	}
+
+	if err := result.apply(op); err != nil {
+		return err
+	}
+
+	if uint64(result.Width)*uint64(result.Height) > uint64(result.img.maxBufferPixels) {
+		return TooBig
+	}
 
 	return nil
 }
 
+func (result *Result) apply(op Operation) error {
+	switch op.Type {
+	case OpRotate:
+		return result.Rotate(op.Degrees)
+	case OpTrim:
+		return result.trim(op)
+	case OpCropPercent:
+		// Percentages of the image as it is so far, at least a pixel.
+		width := (result.Width*op.Width + 50) / 100
+		height := (result.Height*op.Height + 50) / 100
+		if width == 0 {
+			width = 1
+		}
+		if height == 0 {
+			height = 1
+		}
+		if width < result.Width || height < result.Height {
+			return result.CropGravity(width, height, op.Gravity)
+		}
+		return nil
+	case OpAspect:
+		// Largest size with the target aspect ratio within the image.
+		width, height := scaleAspect(op.Width, op.Height, result.Width, result.Height, true)
+		if width < result.Width || height < result.Height {
+			return result.Crop(width, height)
+		}
+		return nil
+	}
+
+	op, width, height, err := result.target(op)
+	if err != nil {
+		return err
+	}
+	if result.img.PixelArt && width > result.Width && height > result.Height {
+		width, height = result.pixelScaled(width, height, op.crops())
+	}
+	if err := result.Resize(width, height); err != nil {
+		return err
+	}
+
+	// If necessary, crop to fit exact size.
+	if op.crops() && (result.Width > op.Width || result.Height > op.Height) {
+		return result.CropGravity(op.Width, op.Height, op.Gravity)
+	}
+
+	// Or pad to it.
+	if op.Type == OpScale && op.Pad != PadNone {
+		return result.padScaled(op.Width, op.Height, op.Pad)
+	}
+
+	return nil
+}
+
+// target returns scaling op, as img.CropUpscale adjusts it, and the size
+// it resizes the result to.
+func (result *Result) target(op Operation) (Operation, uint, uint, error) {
+	// Until transformed, scale relative to the original dimensions,
+	// avoiding rounding errors from JPEG pre-scaling.
+	width, height := result.Width, result.Height
+	if !result.transformed {
+		width, height = result.img.Width, result.img.Height
+	}
+
+	// Decide how to crop a source smaller than the target in both dimensions.
+	if op.crops() && op.Width > width && op.Height > height {
+		switch result.img.CropUpscale {
+		case UpscaleReject:
+			return op, 0, 0, WouldUpscale
+		case UpscaleClamp:
+			// Largest size with the target aspect ratio within the source.
+			op.Width, op.Height = scaleAspect(op.Width, op.Height, width, height, true)
+		}
+	}
+
+	width, height = op.scaled(width, height)
+	return op, width, height, nil
+}
+
+// trim crops away a matte, then scales to cover op's size and crops the
+// overflow, or if op.Pad, scales to fit within it and pads.
+func (result *Result) trim(op Operation) error {
+	matte, err := result.trimMatte(result.img.TrimFuzz)
+	if err != nil {
+		return err
+	}
+	defer matte.Destroy()
+
+	if op.Pad == PadNone {
+		op.Type = OpCrop
+		return result.apply(op)
+	}
+
+	op.Type = OpScale
+	if op.Pad == PadBlur {
+		return result.apply(op)
+	}
+
+	op.Pad = PadNone
+	if err := result.apply(op); err != nil {
+		return err
+	}
+	return result.pad(op.Width, op.Height, matte)
+}
+
 func (result *Result) Get() ([]byte, error) {
-	// If the image shrunk, apply a light sharpening pass
-	if result.shrank && result.img.Sharpen {
-		if err := result.wand.UnsharpMaskImage(0, 0.8, 0.6, 0.05); err != nil {
+	// Fix orientation.  Only stills have EXIF orientation to fix.
+	if err := result.Orientation.Fix(result.wand); err != nil {
+		return nil, err
+	}
+
+	result.format = result.fallbackFormat()
+
+	// Display P3 pixels are only kept in formats that can be labeled as
+	// such, which a fallback or GetAs format may not be.
+	if result.p3 && !iccFormats[result.format] {
+		if err := result.each(func() error { return result.wand.ProfileImage("icc", []byte(sRGB_IEC61966_2_1_black_scaled)) }); err != nil {
 			return nil, err
 		}
+		result.p3 = false
 	}
 
-	// Only save at 8 bits per channel.
-	if err := result.wand.SetImageDepth(8); err != nil {
+	if err := result.each(result.finish); err != nil {
 		return nil, err
 	}
 
-	// Fix orientation.
-	if err := result.Orientation.Fix(result.wand); err != nil {
+	// Frame what was sharpened, so the frame's edge isn't.
+	if err := result.border(); err != nil {
 		return nil, err
 	}
 
+	quality := uint(95)
+
+	if result.img.Preview {
+		quality = result.img.PreviewQuality
+	} else if result.img.Quality > 0 {
+		quality = result.img.Quality
+	} else if result.format == "JPEG" {
+		quality = result.jpegQuality()
+	}
+
+	interlaced := result.img.Progressive
+	if v, ok := result.img.Interlace[result.format]; ok {
+		interlaced = v
+	}
+
+	interlace := imagick.INTERLACE_NO
+	if interlaced || result.img.Preview {
+		interlace = imagick.INTERLACE_LINE
+		if t, ok := interlaceTypes[result.format]; ok {
+			interlace = t
+		}
+	}
+
+	return result.compress(result.format, quality, interlace)
+}
+
+// Each format's own interlacing: progressive JPEG, Adam7 PNG, and GIF's
+// four passes of rows.  Others are interlaced by line.
+var interlaceTypes = map[string]imagick.InterlaceType{
+	"GIF":  imagick.INTERLACE_GIF,
+	"JPEG": imagick.INTERLACE_JPEG,
+	"PNG":  imagick.INTERLACE_PNG,
+}
+
+// finish applies the final touches to a frame before it is compressed.
+func (result *Result) finish() error {
+	// Apply requested blur to the shrunken image, if not done on decode.
+	if result.img.BlurFactor > 0 && result.img.BlurAfterResize && result.scale < 1 {
+		if err := result.wand.GaussianBlurImage(0, result.img.BlurFactor); err != nil {
+			return err
+		}
+	}
+
+	// If the image shrunk (enough), apply a light sharpening pass
+	if result.shrank && result.img.Sharpen && result.scale*result.img.SharpenThreshold < 1 {
+		if err := result.wand.UnsharpMaskImage(0, 0.8, result.sharpenAmount(), 0.05); err != nil {
+			return err
+		}
+	}
+
+	// Enlarging leaves shrank unset, so that sharpening doesn't amplify
+	// the blur and artifacts of interpolation, unless asked for an even
+	// lighter pass.
+	if !result.shrank && result.scale > 1 && result.img.Sharpen && result.img.UpscaleSharpen {
+		if err := result.wand.UnsharpMaskImage(0, 0.5, 0.4, 0.05); err != nil {
+			return err
+		}
+	}
+
+	// Only save at 8 bits per channel.
+	if err := result.wand.SetImageDepth(8); err != nil {
+		return err
+	}
+
 	// Stretch contrast if AutoContrast flag set.
 	if result.img.AutoContrast {
-		if err := result.wand.NormalizeImage(); err != nil {
-			return nil, err
+		if err := result.autoContrast(); err != nil {
+			return err
+		}
+	}
+
+	// Stretch levels to the full range if AutoLevel flag set.
+	if result.img.AutoLevel {
+		if err := result.wand.AutoLevelImage(); err != nil {
+			return err
+		}
+	}
+
+	// Correct gamma towards a mid-gray mean if AutoGamma flag set.
+	if result.img.AutoGamma {
+		if err := result.wand.AutoGammaImage(); err != nil {
+			return err
 		}
 	}
 
 	// Remove extraneous metadata and color profiles.
-	if err := result.wand.StripImage(); err != nil {
-		result.Close()
-		return nil, err
+	if err := result.strip(); err != nil {
+		return err
+	}
+
+	// Tag physical resolution after stripping, so the encoder writes it out.
+	if result.img.Density > 0 {
+		if err := result.wand.SetImageUnits(imagick.RESOLUTION_PIXELS_PER_INCH); err != nil {
+			return err
+		}
+		if err := result.wand.SetImageResolution(result.img.Density, result.img.Density); err != nil {
+			return err
+		}
 	}
 
 	hasAlpha := result.wand.GetImageAlphaChannel()
 	if hasAlpha {
 		// Don't preserve data for fully-transparent pixels.
 		if err := result.wand.SetImageAlphaChannel(imagick.ALPHA_CHANNEL_BACKGROUND); err != nil {
-			return nil, err
+			return err
 		}
 	}
 
-	quality := uint(95)
+	return nil
+}
+
+// sharpenAmount is how strongly to sharpen a shrunk image.  Detail lost
+// to shrinking grows with the ratio, so small thumbnails can take more.
+func (result *Result) sharpenAmount() float64 {
+	const amount = 0.6
+	if result.img.SharpenCurve <= 0 {
+		return amount
+	}
+
+	curved := amount * math.Pow(1/result.scale, result.img.SharpenCurve)
+	if curved > result.img.SharpenMaxAmount {
+		// But never below the fixed amount.
+		return math.Max(result.img.SharpenMaxAmount, amount)
+	}
+	return curved
+}
+
+// jpegQuality is the quality to save a JPEG at.  Artifacts are harder to
+// see in small images, so JpegQualityCurve may lower it for them.
+func (result *Result) jpegQuality() uint {
+	curve := result.img.JpegQualityCurve
+	if len(curve) == 0 {
+		return result.img.JpegQuality
+	}
+
+	pixels := result.Width * result.Height
+	if pixels <= curve[0].Pixels {
+		return curve[0].Quality
+	}
+
+	for i := 1; i < len(curve); i++ {
+		lo, hi := curve[i-1], curve[i]
+		if pixels > hi.Pixels {
+			continue
+		}
+
+		// Sizes grow geometrically, so interpolate by their logarithm.
+		f := math.Log(float64(pixels)/float64(lo.Pixels)) / math.Log(float64(hi.Pixels)/float64(lo.Pixels))
+		return uint(float64(lo.Quality) + f*(float64(hi.Quality)-float64(lo.Quality)) + 0.5)
+	}
+
+	return curve[len(curve)-1].Quality
+}
+
+func (result *Result) strip() error {
+	xmp := ""
+	if result.img.KeepXMP {
+		xmp = result.wand.GetImageProfile("xmp")
+	}
+
+	if err := result.wand.StripImage(); err != nil {
+		return err
+	}
 
-	if result.img.OutputFormat == "JPEG" {
-		quality = result.img.JpegQuality
+	// Put back requested metadata.
+	if xmp != "" {
+		if err := result.wand.SetImageProfile("xmp", []byte(xmp)); err != nil {
+			return err
+		}
+	}
+
+	// Display P3 pixels would look oversaturated if not labeled as such.
+	if result.p3 && iccFormats[result.format] {
+		return result.wand.SetImageProfile("icc", []byte(compactDisplayP3))
+	}
+
+	// Pixels are already sRGB, so this only labels them as such, for
+	// viewers that would otherwise assume the display's own color space.
+	// An RGB profile isn't valid on grayscale, which is unambiguous anyway.
+	if result.img.EmbedSRGB && iccFormats[result.format] && !result.gray {
+		if err := result.wand.SetImageProfile("icc", []byte(compactSRGB)); err != nil {
+			return err
+		}
 	}
 
-	return result.compress(result.img.OutputFormat, quality, imagick.INTERLACE_LINE) // Progressive
+	return nil
+}
+
+// Output formats that can embed an ICC profile.
+var iccFormats = map[string]bool{
+	"AVIF": true,
+	"JPEG": true,
+	"PNG":  true,
+	"WEBP": true,
+}
+
+func (result *Result) autoContrast() error {
+	switch result.img.AutoContrastMode {
+	case ContrastPerChannel:
+		for _, channel := range []imagick.ChannelType{imagick.CHANNEL_RED, imagick.CHANNEL_GREEN, imagick.CHANNEL_BLUE} {
+			if err := result.wand.NormalizeImageChannel(channel); err != nil {
+				return err
+			}
+		}
+		return nil
+	case ContrastCLAHE:
+		// Zero tile size lets ImageMagick pick 1/8th of the image; 128 bins and a
+		// clip limit of 3 avoid the over-brightening of a global stretch.
+		return result.wand.CLAHEImage(0, 0, 128, 3)
+	default:
+		return result.wand.NormalizeImage()
+	}
 }
 
 func (result *Result) compress(format string, quality uint, interlace imagick.InterlaceType) ([]byte, error) {
-	if err := result.wand.SetImageFormat(format); err != nil {
-		return nil, err
+	// Animated PNGs are saved as APNG, keeping each frame's delay and the
+	// loop count from the source.
+	if result.animated && format == "PNG" {
+		format = "APNG"
 	}
 
-	if err := result.wand.SetImageCompressionQuality(quality); err != nil {
+	err := result.each(func() error {
+		if err := result.wand.SetImageFormat(format); err != nil {
+			return err
+		}
+
+		return result.wand.SetImageCompressionQuality(quality)
+	})
+	if err != nil {
 		return nil, err
 	}
 
+	// A tiny image shows at once anyway, and progressive encoding's
+	// extra tables and scans outweigh its better compression.  Previews
+	// are there to show fast, whatever their size.
+	if !result.img.Preview && result.Width*result.Height < result.img.ProgressiveMinPixels {
+		interlace = imagick.INTERLACE_NO
+	}
+
 	if err := result.wand.SetInterlaceScheme(interlace); err != nil {
 		return nil, err
 	}
 
+	switch format {
+	case "JPEG":
+		if err := result.jpegOptions(); err != nil {
+			return nil, err
+		}
+	case "WEBP":
+		if err := result.webpOptions(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := result.applyDefines(); err != nil {
+		return nil, err
+	}
+
 	// Run the format-specific compressor, return the byte slice.
-	return result.wand.GetImageBlob(), nil
+	var blob []byte
+	if result.animated {
+		result.wand.ResetIterator()
+		blob = result.wand.GetImagesBlob()
+	} else {
+		blob = result.wand.GetImageBlob()
+	}
+
+	// ImageMagick reports a failed encode as empty output, not an error.
+	if len(blob) == 0 {
+		return nil, NoOutput
+	}
+	return blob, nil
+}
+
+func (result *Result) jpegOptions() error {
+	// Optimized Huffman coding costs CPU, but is lossless and saves a few percent.
+	if result.img.JpegOptimizeCoding {
+		if err := result.wand.SetOption("jpeg:optimize-coding", "true"); err != nil {
+			return err
+		}
+	}
+
+	if result.img.JpegDctMethod != "" {
+		if err := result.wand.SetOption("jpeg:dct-method", result.img.JpegDctMethod); err != nil {
+			return err
+		}
+	}
+
+	// Restart markers let a decoder resync after corruption, at the
+	// cost of a few bytes each.
+	if result.img.JpegRestartInterval > 0 {
+		if err := result.wand.SetOption("jpeg:restart-interval", strconv.Itoa(int(result.img.JpegRestartInterval))); err != nil {
+			return err
+		}
+	}
+
+	// Subsampling chroma differently than the source did loses more of it,
+	// or spends bytes on detail that was already lost.
+	if result.img.JpegKeepSampling && result.sampling != "" {
+		if err := result.wand.SetOption("jpeg:sampling-factor", result.sampling); err != nil {
+			return err
+		}
+	}
+
+	// JPEG's YCbCr transform and chroma subsampling both cost some color
+	// accuracy.  RGB (libjpeg's JCS_RGB) keeps every channel at full
+	// resolution, as 4:4:4, whatever JpegKeepSampling says.  Defines are
+	// applied after this, so may still change either.
+	if result.img.JpegRGB {
+		if err := result.wand.SetOption("jpeg:colorspace", "2"); err != nil {
+			return err
+		}
+		if err := result.wand.SetOption("jpeg:sampling-factor", "1x1,1x1,1x1"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (result *Result) webpOptions() error {
+	// Lossless WEBP stores straight, unpremultiplied alpha exactly, and
+	// "exact" keeps the color under it as we left it.
+	if result.img.WebpLossless {
+		if err := result.wand.SetOption("webp:lossless", "true"); err != nil {
+			return err
+		}
+		return result.wand.SetOption("webp:exact", "true")
+	}
+
+	// Lossy alpha makes soft shadows and edges band visibly, so it is
+	// compressed separately from color, and losslessly by default.
+	if result.wand.GetImageAlphaChannel() {
+		if err := result.wand.SetOption("webp:alpha-quality", strconv.Itoa(int(result.img.WebpAlphaQuality))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetAs is Get, saving in format rather than the usual one.  It leaves
+// result as it was, so it may be called again for other formats.
+func (result *Result) GetAs(format string) ([]byte, error) {
+	clone := result.Clone()
+	defer clone.Close()
+
+	clone.format = format
+	return clone.Get()
+}
+
+// GetSmallest is Get, but an opaque still whose usual format is one of
+// formats is saved in each of them, and the smallest is returned, as no
+// one format always wins.  That costs an encode per format.
+func (result *Result) GetSmallest(formats []string) ([]byte, error) {
+	usual := false
+	for _, format := range formats {
+		usual = usual || format == result.format
+	}
+	if !usual || result.animated || result.wand.GetImageAlphaChannel() {
+		return result.Get()
+	}
+
+	var smallest []byte
+	for _, format := range formats {
+		if format == result.format {
+			continue
+		}
+		blob, err := result.GetAs(format)
+		if err != nil {
+			return nil, err
+		}
+		if smallest == nil || len(blob) < len(smallest) {
+			smallest = blob
+		}
+	}
+
+	blob, err := result.Get()
+	if err != nil {
+		return nil, err
+	}
+	if smallest != nil && len(smallest) < len(blob) {
+		return smallest, nil
+	}
+	return blob, nil
+}
+
+// Clone returns an independent copy of result, so several variants can be
+// derived from a single decode.  The clone owns a full copy of the pixel
+// buffer, so each one costs as much memory as the original, and each must
+// be Close()d separately.
+func (result *Result) Clone() *Result {
+	clone := *result
+	clone.wand = result.wand.Clone()
+	return &clone
 }
 
 func (result *Result) Close() {
@@ -0,0 +1,68 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package imager
+
+import (
+	"github.com/gographics/imagick/imagick"
+)
+
+// Output formats that can hold transparency.
+var alphaFormats = map[string]bool{
+	"GIF":  true,
+	"PNG":  true,
+	"WEBP": true,
+}
+
+// Rotate turns the image clockwise by degrees, enlarging it to fit.  Unless
+// degrees is a multiple of 90, this exposes corners, which are filled with
+// img.BackgroundColor.  A transparent fill switches output to PNG if the
+// output format can't hold transparency.
+func (result *Result) Rotate(degrees float64) error {
+	background := imagick.NewPixelWand()
+	defer background.Destroy()
+	if !background.SetColor(result.img.BackgroundColor) {
+		return BadColor
+	}
+	transparent := background.GetAlpha() < 1
+
+	// A colored fill needs color channels to go in.
+	if background.GetRed() != background.GetGreen() || background.GetGreen() != background.GetBlue() {
+		if err := result.promote(); err != nil {
+			return err
+		}
+	}
+
+	// Rotate what the viewer sees, rather than the stored pixels.
+	if err := result.Orientation.Fix(result.wand); err != nil {
+		return err
+	}
+
+	err := result.each(func() error {
+		if transparent {
+			if err := result.wand.SetImageAlphaChannel(imagick.ALPHA_CHANNEL_SET); err != nil {
+				return err
+			}
+		}
+
+		if err := result.wand.RotateImage(background, degrees); err != nil {
+			return err
+		}
+
+		// Rotation offsets the virtual canvas by the enlargement.
+		return result.wand.ResetImagePage("")
+	})
+	if err != nil {
+		return err
+	}
+
+	if transparent && !alphaFormats[result.format] {
+		result.format = "PNG"
+	}
+
+	result.Width, result.Height = result.wand.GetImageWidth(), result.wand.GetImageHeight()
+	result.transformed = true
+
+	return nil
+}
@@ -0,0 +1,11 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package imager
+
+// compactSRGB is a 580-byte sRGB profile, for re-embedding in output.  It
+// has the standard primaries and D50 white point, and approximates the sRGB
+// tone curve with 64 points shared by all three channels, which is close
+// enough for 8-bit output at a fifth the size of the ICC's profile.
+const compactSRGB = "\x00\x00\x02\x44\x00\x00\x00\x00\x02\x10\x00\x00\x6d\x6e\x74\x72\x52\x47\x42\x20\x58\x59\x5a\x20\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x61\x63\x73\x70\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xf6\xd6\x00\x01\x00\x00\x00\x00\xd3\x2d\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x09\x64\x65\x73\x63\x00\x00\x00\xf0\x00\x00\x00\x5f\x63\x70\x72\x74\x00\x00\x01\x50\x00\x00\x00\x16\x77\x74\x70\x74\x00\x00\x01\x68\x00\x00\x00\x14\x72\x58\x59\x5a\x00\x00\x01\x7c\x00\x00\x00\x14\x67\x58\x59\x5a\x00\x00\x01\x90\x00\x00\x00\x14\x62\x58\x59\x5a\x00\x00\x01\xa4\x00\x00\x00\x14\x72\x54\x52\x43\x00\x00\x01\xb8\x00\x00\x00\x8c\x67\x54\x52\x43\x00\x00\x01\xb8\x00\x00\x00\x8c\x62\x54\x52\x43\x00\x00\x01\xb8\x00\x00\x00\x8c\x64\x65\x73\x63\x00\x00\x00\x00\x00\x00\x00\x05\x73\x52\x47\x42\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x74\x65\x78\x74\x00\x00\x00\x00\x50\x75\x62\x6c\x69\x63\x20\x44\x6f\x6d\x61\x69\x6e\x00\x00\x00\x58\x59\x5a\x20\x00\x00\x00\x00\x00\x00\xf6\xd6\x00\x01\x00\x00\x00\x00\xd3\x2d\x58\x59\x5a\x20\x00\x00\x00\x00\x00\x00\x6f\xa4\x00\x00\x38\xf6\x00\x00\x03\x8f\x58\x59\x5a\x20\x00\x00\x00\x00\x00\x00\x62\x96\x00\x00\xb7\x87\x00\x00\x18\xdc\x58\x59\x5a\x20\x00\x00\x00\x00\x00\x00\x24\xa2\x00\x00\x0f\x83\x00\x00\xb6\xcf\x63\x75\x72\x76\x00\x00\x00\x00\x00\x00\x00\x40\x00\x00\x00\x51\x00\xa1\x00\xf4\x01\x59\x01\xd2\x02\x61\x03\x08\x03\xc5\x04\x9c\x05\x8c\x06\x97\x07\xbc\x08\xfd\x0a\x5b\x0b\xd6\x0d\x6f\x0f\x27\x10\xfd\x12\xf3\x15\x0a\x17\x41\x19\x9a\x1c\x15\x1e\xb2\x21\x72\x24\x56\x27\x5e\x2a\x8a\x2d\xdb\x31\x52\x34\xef\x38\xb1\x3c\x9b\x40\xac\x44\xe4\x49\x45\x4d\xce\x52\x80\x57\x5b\x5c\x60\x61\x8e\x66\xe8\x6c\x6c\x72\x1b\x77\xf6\x7d\xfd\x84\x30\x8a\x8f\x91\x1c\x97\xd6\x9e\xbe\xa5\xd4\xad\x18\xb4\x8b\xbc\x2d\xc3\xfe\xcb\xff\xd4\x30\xdc\x91\xe5\x23\xed\xe5\xf6\xd9\xff\xff"
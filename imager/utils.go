@@ -19,28 +19,50 @@ func detectFormats(blob []byte) (string, string) {
 		return "GIF", "GIF"
 	case "image/bmp":
 		return "BMP", "JPEG"
+	case "image/webp":
+		return "WEBP", "WEBP"
 	default:
 		return "", ""
 	}
 }
 
-func imageMetaData(blob []byte) (uint, uint, *Orientation, string, error) {
+// imageMetaData describes blob, and returns its number of frames and its
+// orientation, without decoding it.  Info.Format is what ImageMagick found,
+// which the caller must check against format.
+func imageMetaData(blob []byte, format string) (*Info, uint, *Orientation, error) {
 	// Allocate a temporary wand.
 	wand := imagick.NewMagickWand()
 	defer wand.Destroy()
 
+	// Security: Use only the decoder for the format we detected, rather
+	// than letting ImageMagick sniff for one.
+	if err := wand.SetFormat(format); err != nil {
+		return nil, 0, nil, err
+	}
+
 	// Get just metadata about the image, don't decode.
 	if err := wand.PingImageBlob(blob); err != nil {
-		return 0, 0, nil, "", err
+		return nil, 0, nil, err
 	}
 
+	frames := wand.GetNumberImages()
+
 	// Make sure we are using the first frame of an animation.
 	wand.ResetIterator()
 
 	orientation := NewOrientation(wand.GetImageOrientation())
 	width, height := orientation.Dimensions(wand.GetImageWidth(), wand.GetImageHeight())
 
-	return width, height, orientation, wand.GetImageFormat(), nil
+	info := &Info{
+		Width:       width,
+		Height:      height,
+		Format:      wand.GetImageFormat(),
+		HasAlpha:    wand.GetImageAlphaChannel(),
+		IsAnimated:  frames > 1,
+		Orientation: orientation.Tag(),
+	}
+
+	return info, frames, orientation, nil
 }
 
 // Scale original (width, height) to result (width, height), maintaining aspect ratio.
@@ -0,0 +1,36 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package imager
+
+import (
+	"encoding/binary"
+)
+
+// webpFeatures reads whether a WebP has alpha or is animated from its
+// first chunk, which ImageMagick doesn't reliably report: some versions
+// ping only an animation's first frame.
+func webpFeatures(blob []byte) (alpha, animated bool) {
+	// A RIFF header, then a chunk's fourcc and size, then its data.
+	if len(blob) < 25 || string(blob[0:4]) != "RIFF" || string(blob[8:12]) != "WEBP" {
+		return false, false
+	}
+
+	switch string(blob[12:16]) {
+	case "VP8X":
+		// Extended: flags for ICC, alpha, EXIF, XMP, and animation.
+		flags := blob[20]
+		return flags&0x10 != 0, flags&0x02 != 0
+	case "VP8L":
+		// Lossless: a signature byte, then 14 bits each of width-1 and
+		// height-1, then whether alpha is used.
+		if blob[20] != 0x2f {
+			return false, false
+		}
+		return binary.LittleEndian.Uint32(blob[21:25])&(1<<28) != 0, false
+	default:
+		// Simple lossy "VP8 " has neither.
+		return false, false
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/die-net/fotomat/imager"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var (
+	imgproxyKey  = flag.String("imgproxy_key", "", "Hex-encoded key to verify imgproxy-style signed URLs under /imgproxy/ (\"\" = disable).")
+	imgproxySalt = flag.String("imgproxy_salt", "", "Hex-encoded salt for -imgproxy_key.")
+)
+
+const imgproxyPrefix = "/imgproxy"
+
+func init() {
+	mux.HandleFunc(imgproxyPrefix+"/", rateLimited(requestLimited(imgproxyHandler)))
+}
+
+func imgproxyHandler(w http.ResponseWriter, r *http.Request) {
+	if *imgproxyKey == "" {
+		imageProxyHandler(w, r)
+		return
+	}
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		sendError(w, nil, http.StatusMethodNotAllowed)
+		return
+	}
+
+	key, err := hex.DecodeString(*imgproxyKey)
+	if err != nil {
+		sendError(w, fmt.Errorf("Bad -imgproxy_key: %v", err), http.StatusInternalServerError)
+		return
+	}
+	salt, err := hex.DecodeString(*imgproxySalt)
+	if err != nil {
+		sendError(w, fmt.Errorf("Bad -imgproxy_salt: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	path, params, err := parseImgproxy(strings.TrimPrefix(r.URL.EscapedPath(), imgproxyPrefix), r.Host, key, salt)
+	if err == imgproxyBadSignature {
+		sendError(w, err, http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		sendBadRequest(w, err)
+		return
+	}
+
+	fetchAndProcessImage(w, sourceURL(r, path), params)
+}
+
+var imgproxyBadSignature = errors.New("Invalid imgproxy signature")
+
+// parseImgproxy verifies and translates the subset of imgproxy's signed URL
+// scheme that we support, like "/SIGNATURE/rs:fill:300:200/q:80/plain/local:///image.jpg".
+// Supported processing options are:
+//
+//	resize, rs            - TYPE:WIDTH:HEIGHT, TYPE being fit (default) or fill
+//	size, s               - WIDTH:HEIGHT
+//	resizing_type, rt     - fit or fill
+//	width, w / height, h  - where 0 keeps the aspect ratio
+//	quality, q            - output quality from 1 to 100
+//
+// The source may be "plain/" followed by an escaped URL, or base64 encoded.
+// Either way, it must be a path on this host, like "/image.jpg",
+// "local:///image.jpg" or "http://HOST/image.jpg".  Any requested extension
+// is ignored, as the output format follows our usual rules.
+func parseImgproxy(path, host string, key, salt []byte) (string, imageParams, error) {
+	parts := strings.Split(path, "/")
+	if len(parts) < 3 || parts[0] != "" {
+		return "", imageParams{}, fmt.Errorf("imgproxy URL is missing a signature")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return "", imageParams{}, imgproxyBadSignature
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+	mac.Write([]byte(strings.TrimPrefix(path, "/"+parts[1])))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return "", imageParams{}, imgproxyBadSignature
+	}
+	parts = parts[2:]
+
+	var params imageParams
+	kind, width, height := "s", "0", "0"
+
+	for ; len(parts) > 0; parts = parts[1:] {
+		args := strings.Split(parts[0], ":")
+		if len(args) < 2 {
+			break
+		}
+
+		switch args[0] {
+		case "resize", "rs":
+			if len(args) != 4 {
+				return "", imageParams{}, fmt.Errorf("imgproxy resize needs a type, width and height")
+			}
+			kind, width, height = args[1], args[2], args[3]
+		case "size", "s":
+			if len(args) != 3 {
+				return "", imageParams{}, fmt.Errorf("imgproxy size needs a width and height")
+			}
+			width, height = args[1], args[2]
+		case "resizing_type", "rt":
+			kind = args[1]
+		case "width", "w":
+			width = args[1]
+		case "height", "h":
+			height = args[1]
+		case "quality", "q":
+			quality, err := strconv.Atoi(args[1])
+			if err != nil || quality < 1 || quality > 100 {
+				return "", imageParams{}, fmt.Errorf("Bad imgproxy quality %q", args[1])
+			}
+			params.quality = uint(quality)
+		default:
+			return "", imageParams{}, fmt.Errorf("Unsupported imgproxy option %q", args[0])
+		}
+	}
+
+	switch kind {
+	case "fit", "s":
+		kind = "s"
+	case "fill", "c":
+		kind = "c"
+	default:
+		return "", imageParams{}, fmt.Errorf("Unsupported imgproxy resizing type %q", kind)
+	}
+
+	if width == "0" && height == "0" {
+		return "", imageParams{}, fmt.Errorf("imgproxy URL needs a width or height")
+	}
+	op, err := parseAspectOperation(kind, width, height)
+	if err != nil {
+		return "", imageParams{}, fmt.Errorf("imgproxy size %sx%s: %v", width, height, err)
+	}
+	params.operations = []imager.Operation{op}
+
+	source, err := imgproxySource(parts)
+	if err != nil {
+		return "", imageParams{}, err
+	}
+
+	u, err := url.Parse(source)
+	if err != nil {
+		return "", imageParams{}, fmt.Errorf("Bad imgproxy source: %v", err)
+	}
+	switch {
+	case u.Scheme == "" && u.Host == "":
+	case u.Scheme == "local" && u.Host == "":
+	case (u.Scheme == "http" || u.Scheme == "https") && u.Host == host:
+	default:
+		return "", imageParams{}, fmt.Errorf("imgproxy source %q isn't on this host", source)
+	}
+	if !strings.HasPrefix(u.Path, "/") {
+		return "", imageParams{}, fmt.Errorf("imgproxy source %q needs an absolute path", source)
+	}
+
+	return u.Path, params, nil
+}
+
+// imgproxySource decodes the source URL from what's left of the path.
+func imgproxySource(parts []string) (string, error) {
+	if len(parts) == 0 || parts[0] == "" {
+		return "", fmt.Errorf("imgproxy URL is missing a source")
+	}
+
+	if parts[0] == "plain" {
+		source, err := url.PathUnescape(strings.Join(parts[1:], "/"))
+		if err != nil {
+			return "", fmt.Errorf("Bad imgproxy source: %v", err)
+		}
+		if i := strings.LastIndex(source, "@"); i >= 0 {
+			source = source[:i]
+		}
+		return source, nil
+	}
+
+	// Base64 sources may be split by slashes and followed by an extension.
+	encoded := strings.Join(parts, "")
+	if i := strings.Index(encoded, "."); i >= 0 {
+		encoded = encoded[:i]
+	}
+	source, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return "", fmt.Errorf("Bad imgproxy source: %v", err)
+	}
+	return string(source), nil
+}
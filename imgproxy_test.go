@@ -0,0 +1,60 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/die-net/fotomat/imager"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseImgproxy(t *testing.T) {
+	key, salt := []byte("secret"), []byte("salty")
+	sign := func(path string) string {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(salt)
+		mac.Write([]byte(path))
+		return "/" + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)) + path
+	}
+
+	path, params, err := parseImgproxy(sign("/rs:fill:300:200/q:80/plain/local:///images/a.jpg@png"), "img.example.com", key, salt)
+	assert.Nil(t, err)
+	assert.Equal(t, path, "/images/a.jpg")
+	assert.Equal(t, params.quality, uint(80))
+	assert.Equal(t, params.operations, []imager.Operation{{Type: imager.OpCrop, Width: 300, Height: 200}})
+
+	// Base64 sources, split by slashes, with an extension.
+	source := base64.RawURLEncoding.EncodeToString([]byte("http://img.example.com/a.jpg"))
+	path, params, err = parseImgproxy(sign("/w:300/"+source[:8]+"/"+source[8:]+".jpg"), "img.example.com", key, salt)
+	assert.Nil(t, err)
+	assert.Equal(t, path, "/a.jpg")
+	assert.Equal(t, params.operations, []imager.Operation{{Type: imager.OpScale, Width: 300, Height: uint(*maxOutputDimension)}})
+
+	// Tampering with a signed URL is refused.
+	signed := sign("/rs:fit:300:200/plain/local:///a.jpg")
+	_, _, err = parseImgproxy(signed[:len(signed)-5]+"b.jpg", "img.example.com", key, salt)
+	assert.Equal(t, err, imgproxyBadSignature)
+	_, _, err = parseImgproxy(signed, "img.example.com", key, []byte("other"))
+	assert.Equal(t, err, imgproxyBadSignature)
+
+	// Unsupported or malformed URLs explain why.
+	for _, path := range []string{
+		"/rs:auto:300:200/plain/local:///a.jpg",
+		"/rs:fit:300/plain/local:///a.jpg",
+		"/q:0/w:300/plain/local:///a.jpg",
+		"/bl:2/w:300/plain/local:///a.jpg",
+		"/w:99999/plain/local:///a.jpg",
+		"/plain/local:///a.jpg",
+		"/w:300/plain/http://elsewhere.example.com/a.jpg",
+		"/w:300/plain/",
+	} {
+		_, _, err := parseImgproxy(sign(path), "img.example.com", key, salt)
+		assert.NotNil(t, err, path)
+		assert.NotEqual(t, err, imgproxyBadSignature, path)
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"net/http"
+)
+
+var (
+	maxURLLength = flag.Int("max_url_length", 4096, "Maximum length of a request's path and query, operations included (0 = unlimited).")
+	maxBodyBytes = flag.Int64("max_body_bytes", 10485760, "Maximum size of a request body (0 = unlimited).")
+)
+
+// requestLimited wraps handler, answering 414 or 413 to requests with
+// URLs or bodies too long to be worth parsing.
+func requestLimited(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if *maxURLLength > 0 && len(r.URL.Path)+len(r.URL.RawQuery) > *maxURLLength {
+			sendError(w, nil, http.StatusRequestURITooLong)
+			return
+		}
+
+		if *maxBodyBytes > 0 {
+			if r.ContentLength > *maxBodyBytes {
+				sendError(w, nil, http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			// Chunked bodies have no length up front, so stop reading
+			// at the limit instead.
+			r.Body = http.MaxBytesReader(w, r.Body, *maxBodyBytes)
+		}
+
+		handler(w, r)
+	}
+}
@@ -6,25 +6,120 @@ package main
 
 import (
 	"flag"
+	"github.com/die-net/fotomat/imager"
+	"io/ioutil"
 	"log"
 	"net/http"
-	_ "net/http/pprof" // Adds http://*/debug/pprof/ to default mux.
+	_ "net/http/pprof" // Adds /debug/pprof/ to default mux, served on -debug_listen.
 	"runtime"
+	"strings"
 )
 
 var (
 	listenAddr      = flag.String("listen", "127.0.0.1:3520", "[IP]:port to listen for incoming connections.")
 	maxImageThreads = flag.Int("max_image_threads", runtime.NumCPU(), "Maximum number of threads simultaneously processing images.")
+	debugListen     = flag.String("debug_listen", "", "[IP]:port to serve profiles on under /debug/pprof/, and ImageMagick's version and formats as JSON on /debug/formats, like \"127.0.0.1:6060\" (\"\" = disable).")
 )
 
 func main() {
 	flag.Parse()
 
-	// Up to max_threads will be allowed to be blocked in ImageMagick.
+	if _, ok := cropUpscalePolicies[*cropUpscale]; !ok {
+		log.Fatalf("Unknown -crop_upscale %q", *cropUpscale)
+	}
+
+	if _, ok := brokenProfilePolicies[*brokenProfile]; !ok {
+		log.Fatalf("Unknown -broken_profile %q", *brokenProfile)
+	}
+
+	var err error
+	if maxFramesByFormat, err = parseFormatLimits(*maxFrames); err != nil {
+		log.Fatal("-max_frames: ", err)
+	}
+
+	if enabledOperations, err = parseOperationList(*enableOperations); err != nil {
+		log.Fatal("-enable_operations: ", err)
+	}
+
+	if interlaceByFormat, err = parseFormatSwitches(*formatInterlace); err != nil {
+		log.Fatal("-format_interlace: ", err)
+	}
+
+	if stillFrameStrategy, stillFrameIndex, err = parseStillFrame(*stillFrame); err != nil {
+		log.Fatal("-still_frame: ", err)
+	}
+
+	if qualityCurve, err = parseQualityCurve(*jpegQualityCurve); err != nil {
+		log.Fatal("-jpeg_quality_curve: ", err)
+	}
+
+	if definesMap, err = parseDefines(*defines); err != nil {
+		log.Fatal("-defines: ", err)
+	}
+
+	if *fallbackFormats != "" {
+		fallbackFormatList = strings.Split(*fallbackFormats, ",")
+		for _, format := range fallbackFormatList {
+			if !imager.CanEncode(format) {
+				log.Fatalf("-fallback_formats: ImageMagick can't encode %q", format)
+			}
+		}
+	}
+
+	if *webpAlphaQuality > 100 {
+		log.Fatal("-webp_alpha_quality must be at most 100")
+	}
+
+	if *maxDPR < 1 {
+		log.Fatal("-max_dpr must be at least 1")
+	}
+
+	if *smallestOpaque && !imager.CanEncode("WEBP") {
+		log.Fatal("-smallest_opaque: ImageMagick can't encode WEBP")
+	}
+
+	if *convertMinBytes > 0 && !imager.CanEncode(*convertFormat) {
+		log.Fatalf("-convert_format: ImageMagick can't encode %q", *convertFormat)
+	}
+
+	*graphicFormat = strings.ToUpper(*graphicFormat)
+	if *graphicFormat != "" && !imager.CanEncode(*graphicFormat) {
+		log.Fatalf("-graphic_format: ImageMagick can't encode %q", *graphicFormat)
+	}
+
+	if *assumeProfile != "" {
+		if assumedProfile, err = ioutil.ReadFile(*assumeProfile); err != nil {
+			log.Fatal("-assume_profile: ", err)
+		}
+	}
+
+	if *assumeCMYKProfile != "" {
+		if assumedCMYKProfile, err = ioutil.ReadFile(*assumeCMYKProfile); err != nil {
+			log.Fatal("-assume_cmyk_profile: ", err)
+		}
+	}
+
+	if *cliOperations != "" {
+		if err := processStdin(*cliOperations); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Up to max_image_threads will be allowed to be blocked in
+	// ImageMagick, split between decoding and encoding unless overridden.
 	poolInit(*maxImageThreads)
 
 	// Allow more threads than that for networking, etc.
 	runtime.GOMAXPROCS(*maxImageThreads * 2)
 
-	log.Fatal(http.ListenAndServe(*listenAddr, nil))
+	// Keep profiles off of the public port, as they're expensive to
+	// generate and reveal internals, as does /debug/formats.
+	if *debugListen != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(*debugListen, http.DefaultServeMux))
+		}()
+	}
+
+	log.Fatal(http.ListenAndServe(*listenAddr, mux))
 }
@@ -0,0 +1,78 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/die-net/fotomat/imager"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// Values of the formats query parameter, "=fm" operations and extensions
+// -extension_format recognizes, for the output formats we might be able to
+// save.
+var multipartFormats = map[string]string{
+	"avif": "AVIF",
+	"gif":  "GIF",
+	"jpeg": "JPEG",
+	"jpg":  "JPEG",
+	"png":  "PNG",
+	"webp": "WEBP",
+}
+
+// parseFormats parses a list of output formats, like "jpeg,webp", as asked
+// for with "?formats=" on a path URL, refusing unknown ones, ones that
+// ImageMagick can't encode, and repeats.
+func parseFormats(list string) ([]string, error) {
+	var formats []string
+	seen := map[string]bool{}
+
+	for _, name := range strings.Split(list, ",") {
+		format, ok := multipartFormats[name]
+		if !ok || !imager.CanEncode(format) {
+			return nil, fmt.Errorf("Unsupported format %q", name)
+		}
+		if seen[format] {
+			return nil, fmt.Errorf("Format %q specified twice", name)
+		}
+		seen[format] = true
+		formats = append(formats, format)
+	}
+
+	return formats, nil
+}
+
+// getMultipart saves result in each of formats, as the parts of a
+// multipart/mixed body, so the image is only decoded and resized once.
+func getMultipart(result *imager.Result, formats []string, header http.Header) ([]byte, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	for _, format := range formats {
+		blob, err := result.GetAs(format)
+		if err != nil {
+			return nil, err
+		}
+
+		// Fallbacks may pick another format than asked for, so sniff.
+		part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {contentType(blob)}})
+		if err != nil {
+			return nil, err
+		}
+		part.Write(blob)
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	header.Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+
+	return body.Bytes(), nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/die-net/fotomat/imager"
+	"net/http"
+)
+
+var overrideKey = flag.String("override_key", "", "Hex-encoded key to verify the signed ?override= settings of trusted callers with (\"\" = disable).")
+
+// overrides are the settings a signed request may change for itself, as
+// JSON like {"max_buffer_pixels":50000000,"animated_output":true}.  Missing
+// ones keep their flag's value.
+type overrides struct {
+	MaxBufferPixels  *uint   `json:"max_buffer_pixels"`
+	MaxImageMemory   *uint64 `json:"max_image_memory"`
+	AnimatedOutput   *bool   `json:"animated_output"`
+	BestEffortDecode *bool   `json:"best_effort_decode"`
+	KeepXMP          *bool   `json:"keep_xmp"`
+}
+
+var overrideBadSignature = errors.New("Invalid override signature")
+
+// parseOverride verifies and decodes the "override" query parameter of r:
+// URL-safe base64 of the JSON of overrides, signed by a "sig" parameter
+// holding the URL-safe base64 HMAC-SHA256, keyed with -override_key, of
+// the path followed by "?override=" and that parameter.  So a signature
+// only applies to the one image it was made for.  Unknown settings are
+// refused, rather than silently ignored.
+func parseOverride(r *http.Request) (*overrides, error) {
+	query := r.URL.Query()
+	encoded := query.Get("override")
+
+	key, err := hex.DecodeString(*overrideKey)
+	if *overrideKey == "" || err != nil {
+		return nil, overrideBadSignature
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(query.Get("sig"))
+	if err != nil {
+		return nil, overrideBadSignature
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(r.URL.Path + "?override=" + encoded))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, overrideBadSignature
+	}
+
+	blob, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("Override isn't URL-safe base64")
+	}
+
+	var o overrides
+	decoder := json.NewDecoder(bytes.NewReader(blob))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&o); err != nil {
+		return nil, fmt.Errorf("Bad override: %v", err)
+	}
+
+	return &o, nil
+}
+
+// bufferPixels returns the max_buffer_pixels to open an image with.
+func (o *overrides) bufferPixels() uint {
+	if o == nil || o.MaxBufferPixels == nil {
+		return *maxBufferPixels
+	}
+	return *o.MaxBufferPixels
+}
+
+// apply sets img's options that o overrides.
+func (o *overrides) apply(img *imager.Imager) {
+	if o == nil {
+		return
+	}
+
+	if o.MaxImageMemory != nil {
+		img.MaxMemory = *o.MaxImageMemory
+	}
+	if o.AnimatedOutput != nil {
+		img.AnimatedOutput = *o.AnimatedOutput
+	}
+	if o.BestEffortDecode != nil {
+		img.BestEffort = *o.BestEffortDecode
+	}
+	if o.KeepXMP != nil {
+		img.KeepXMP = *o.KeepXMP
+	}
+}
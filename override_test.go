@@ -0,0 +1,44 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestOverride(t *testing.T) {
+	*overrideKey = "736563726574"
+	defer func() { *overrideKey = "" }()
+
+	sign := func(filename, settings string) string {
+		path := "/imager/testdata/" + filename
+		override := base64.RawURLEncoding.EncodeToString([]byte(settings))
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(path + "?override=" + override))
+		return filename + "?override=" + override + "&sig=" + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+
+	// Signed settings apply to that request only.
+	assert.Equal(t, status(sign("watermelon.jpg=s100x100", `{"max_buffer_pixels":1000}`)), http.StatusRequestEntityTooLarge)
+	assert.Nil(t, isSize(sign("watermelon.jpg=s100x100", `{"keep_xmp":true}`), "JPEG", 74, 100))
+	assert.Nil(t, isSize("watermelon.jpg=s100x100", "JPEG", 74, 100))
+
+	// A signature is only good for the image it was made for.
+	signed := sign("watermelon.jpg=s100x100", `{"max_buffer_pixels":1000}`)
+	assert.Equal(t, status("orient1.jpg"+signed[len("watermelon.jpg"):]), http.StatusForbidden)
+	assert.Equal(t, status("watermelon.jpg=s100x100?override=e30&sig=AAAA"), http.StatusForbidden)
+
+	// Settings that can't be overridden are refused.
+	assert.Equal(t, status(sign("watermelon.jpg=s100x100", `{"enable_pdf":true}`)), http.StatusBadRequest)
+
+	// Without -override_key, nothing is trusted.
+	*overrideKey = ""
+	assert.Equal(t, status(signed), http.StatusForbidden)
+}
@@ -0,0 +1,97 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	rateLimit       = flag.Float64("rate_limit", 0, "Maximum sustained requests per second from each client (0 = unlimited).")
+	rateLimitBurst  = flag.Int("rate_limit_burst", 10, "Number of requests a client may make at once before -rate_limit applies.")
+	rateLimitHeader = flag.String("rate_limit_header", "", "Header identifying clients for -rate_limit, like X-Forwarded-For (\"\" = remote IP).")
+	limiter         = &rateLimiter{buckets: map[string]*tokenBucket{}}
+)
+
+// rateLimited wraps handler, answering 429 to clients exceeding -rate_limit.
+func rateLimited(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if *rateLimit > 0 {
+			ok, wait := limiter.allow(clientKey(r), time.Now(), *rateLimit, *rateLimitBurst)
+			if !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				sendError(w, nil, http.StatusTooManyRequests)
+				return
+			}
+		}
+
+		handler(w, r)
+	}
+}
+
+func clientKey(r *http.Request) string {
+	if *rateLimitHeader != "" {
+		if key := forwardedHeader(r, *rateLimitHeader); key != "" {
+			return key
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+// allow takes a token from key's bucket, which refills at rate per second up
+// to burst.  If it's empty, it returns how long until a token is available.
+func (l *rateLimiter) allow(key string, now time.Time, rate float64, burst int) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Occasionally forget clients whose buckets would have refilled anyway.
+	full := time.Duration(float64(burst) / rate * float64(time.Second))
+	if now.Sub(l.swept) > full {
+		for k, b := range l.buckets {
+			if now.Sub(b.updated) > full {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+
+	b := l.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: float64(burst), updated: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+
+	b.tokens--
+	return true, 0
+}
@@ -0,0 +1,35 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := &rateLimiter{buckets: map[string]*tokenBucket{}}
+	now := time.Now()
+
+	// Allow a burst of 2, then refuse.
+	ok, _ := l.allow("a", now, 1, 2)
+	assert.True(t, ok)
+	ok, _ = l.allow("a", now, 1, 2)
+	assert.True(t, ok)
+	ok, wait := l.allow("a", now, 1, 2)
+	assert.False(t, ok)
+	assert.Equal(t, wait, time.Second)
+
+	// Other clients have their own buckets.
+	ok, _ = l.allow("b", now, 1, 2)
+	assert.True(t, ok)
+
+	// Refill at the given rate.
+	ok, _ = l.allow("a", now.Add(time.Second), 1, 2)
+	assert.True(t, ok)
+	ok, _ = l.allow("a", now.Add(time.Second), 1, 2)
+	assert.False(t, ok)
+}
@@ -0,0 +1,140 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/die-net/fotomat/imager"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	thumborURLs = flag.Bool("thumbor_urls", false, "Also accept Thumbor-style URLs, like \"/unsafe/300x200/smart/image.jpg\", to ease migration.")
+)
+
+func init() {
+	mux.HandleFunc("/unsafe/", rateLimited(requestLimited(thumborHandler)))
+}
+
+func thumborHandler(w http.ResponseWriter, r *http.Request) {
+	if !*thumborURLs {
+		imageProxyHandler(w, r)
+		return
+	}
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		sendError(w, nil, http.StatusMethodNotAllowed)
+		return
+	}
+
+	path, params, err := parseThumbor(r.URL.Path)
+	if err != nil {
+		sendBadRequest(w, err)
+		return
+	}
+
+	fetchAndProcessImage(w, sourceURL(r, path), params)
+}
+
+var (
+	matchThumborSize   = regexp.MustCompile(`^(\d{1,5})x(\d{1,5})$`)
+	matchThumborFilter = regexp.MustCompile(`^([a-z_]+)\((.*)\)$`)
+)
+
+// parseThumbor translates the subset of Thumbor's URL scheme we support
+// into the equivalent operations, like "/unsafe/300x200/smart/image.jpg":
+//
+//	unsafe            - required, as signed URLs aren't supported
+//	fit-in            - optional, scale within WxH rather than cropping to it
+//	WxH               - required, where 0 keeps the aspect ratio
+//	center, middle    - optional, the only supported alignments
+//	smart             - optional, treated as a centered crop
+//	filters:quality() - optional, output quality from 1 to 100
+//
+// The rest of the path is the image, which is fetched from the same host.
+func parseThumbor(path string) (string, imageParams, error) {
+	parts := strings.Split(path, "/")
+	if len(parts) < 3 || parts[0] != "" || parts[1] != "unsafe" {
+		return "", imageParams{}, fmt.Errorf("Thumbor URLs must start with /unsafe/")
+	}
+	parts = parts[2:]
+
+	kind := "c"
+	if parts[0] == "fit-in" {
+		kind = "s"
+		parts = parts[1:]
+	}
+
+	if len(parts) == 0 {
+		return "", imageParams{}, fmt.Errorf("Thumbor URL is missing a size")
+	}
+	g := matchThumborSize.FindStringSubmatch(parts[0])
+	if len(g) != 3 {
+		return "", imageParams{}, fmt.Errorf("Unsupported Thumbor size %q", parts[0])
+	}
+	parts = parts[1:]
+
+	if g[1] == "0" && g[2] == "0" {
+		return "", imageParams{}, fmt.Errorf("Thumbor size needs a width or height")
+	}
+
+	op, err := parseAspectOperation(kind, g[1], g[2])
+	if err != nil {
+		return "", imageParams{}, fmt.Errorf("Thumbor size %q: %v", g[0], err)
+	}
+
+	var params imageParams
+	params.operations = []imager.Operation{op}
+
+	for len(parts) > 0 {
+		part := parts[0]
+		switch {
+		case part == "center" || part == "middle" || part == "smart":
+			// We only crop around the center.
+		case part == "left" || part == "right" || part == "top" || part == "bottom" || part == "trim":
+			return "", imageParams{}, fmt.Errorf("Unsupported Thumbor option %q", part)
+		case strings.HasPrefix(part, "filters:"):
+			if err := parseThumborFilters(&params, part[len("filters:"):]); err != nil {
+				return "", imageParams{}, err
+			}
+		default:
+			if len(parts) == 1 && part == "" {
+				return "", imageParams{}, fmt.Errorf("Thumbor URL is missing an image")
+			}
+			return "/" + strings.Join(parts, "/"), params, nil
+		}
+		parts = parts[1:]
+	}
+
+	return "", imageParams{}, fmt.Errorf("Thumbor URL is missing an image")
+}
+
+// parseThumborFilters records filters like "quality(80):foo(1)" in params,
+// failing on any we don't support.
+func parseThumborFilters(params *imageParams, filters string) error {
+	for _, filter := range strings.Split(filters, ":") {
+		g := matchThumborFilter.FindStringSubmatch(filter)
+		if len(g) != 3 {
+			return fmt.Errorf("Malformed Thumbor filter %q", filter)
+		}
+
+		switch g[1] {
+		case "quality":
+			quality, err := strconv.Atoi(g[2])
+			if err != nil || quality < 1 || quality > 100 || params.quality != 0 {
+				return fmt.Errorf("Bad Thumbor quality %q", g[2])
+			}
+			params.quality = uint(quality)
+		default:
+			return fmt.Errorf("Unsupported Thumbor filter %q", g[1])
+		}
+	}
+
+	return nil
+}
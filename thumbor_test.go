@@ -0,0 +1,45 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/die-net/fotomat/imager"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseThumbor(t *testing.T) {
+	path, params, err := parseThumbor("/unsafe/300x200/smart/filters:quality(80)/images/a.jpg")
+	assert.Nil(t, err)
+	assert.Equal(t, path, "/images/a.jpg")
+	assert.Equal(t, params.quality, uint(80))
+	assert.Equal(t, params.operations, []imager.Operation{{Type: imager.OpCrop, Width: 300, Height: 200}})
+
+	path, params, err = parseThumbor("/unsafe/fit-in/300x200/a.jpg")
+	assert.Nil(t, err)
+	assert.Equal(t, path, "/a.jpg")
+	assert.Equal(t, params.operations, []imager.Operation{{Type: imager.OpScale, Width: 300, Height: 200}})
+
+	// A zero dimension scales to the other.
+	_, params, err = parseThumbor("/unsafe/300x0/a.jpg")
+	assert.Nil(t, err)
+	assert.Equal(t, params.operations, []imager.Operation{{Type: imager.OpScale, Width: 300, Height: uint(*maxOutputDimension)}})
+
+	// Unsupported or malformed URLs explain why.
+	for _, path := range []string{
+		"/300x200/a.jpg",
+		"/unsafe/a.jpg",
+		"/unsafe/0x0/a.jpg",
+		"/unsafe/99999x200/a.jpg",
+		"/unsafe/300x200/left/a.jpg",
+		"/unsafe/300x200/filters:grayscale()/a.jpg",
+		"/unsafe/300x200/filters:quality(0)/a.jpg",
+		"/unsafe/300x200/filters:quality(80):quality(90)/a.jpg",
+		"/unsafe/300x200/",
+	} {
+		_, _, err := parseThumbor(path)
+		assert.NotNil(t, err, path)
+	}
+}
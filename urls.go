@@ -0,0 +1,47 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var (
+	baseURL               = flag.String("base_url", "", "Scheme and host for URLs in responses, like \"https://img.example.com\" (\"\" = from the request).")
+	trustForwardedHeaders = flag.Bool("trust_forwarded_headers", false, "Build URLs in responses from X-Forwarded-Proto and X-Forwarded-Host, when behind a proxy.")
+)
+
+// absoluteURL returns the URL a client should use to fetch path, which may
+// differ from what we see when we're behind a load balancer or CDN.
+func absoluteURL(r *http.Request, path string) string {
+	if *baseURL != "" {
+		return strings.TrimRight(*baseURL, "/") + path
+	}
+
+	u := url.URL{Scheme: "http", Host: r.Host, Path: path}
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+
+	if *trustForwardedHeaders {
+		if proto := forwardedHeader(r, "X-Forwarded-Proto"); proto == "http" || proto == "https" {
+			u.Scheme = proto
+		}
+		if host := forwardedHeader(r, "X-Forwarded-Host"); host != "" {
+			u.Host = host
+		}
+	}
+
+	return u.String()
+}
+
+// forwardedHeader returns the value added by the proxy closest to the
+// client, if a header was appended to by several.
+func forwardedHeader(r *http.Request, name string) string {
+	return strings.TrimSpace(strings.Split(r.Header.Get(name), ",")[0])
+}
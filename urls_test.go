@@ -0,0 +1,31 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestAbsoluteURL(t *testing.T) {
+	r, err := http.NewRequest("GET", "http://127.0.0.1:3520/a.jpg=s10x10", nil)
+	assert.Nil(t, err)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	r.Header.Set("X-Forwarded-Host", "img.example.com, 10.0.0.1")
+
+	// By default, ignore forwarded headers that a client could forge.
+	assert.Equal(t, absoluteURL(r, "/b.jpg=s20x20"), "http://127.0.0.1:3520/b.jpg=s20x20")
+
+	// Use the outermost proxy's idea of our address, if trusted.
+	*trustForwardedHeaders = true
+	assert.Equal(t, absoluteURL(r, "/b.jpg=s20x20"), "https://img.example.com/b.jpg=s20x20")
+	*trustForwardedHeaders = false
+
+	// A configured base URL overrides both.
+	*baseURL = "https://cdn.example.com/"
+	assert.Equal(t, absoluteURL(r, "/b.jpg=s20x20"), "https://cdn.example.com/b.jpg=s20x20")
+	*baseURL = ""
+}
@@ -0,0 +1,124 @@
+// Copyright 2013-2014 Aaron Hopkins. All rights reserved.
+// Use of this source code is governed by the GPL v2 license
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/die-net/fotomat/imager"
+	"net/http"
+	"strings"
+)
+
+const validatePrefix = "/validate"
+
+func init() {
+	mux.HandleFunc(validatePrefix+"/", rateLimited(requestLimited(validateHandler)))
+}
+
+// validation is what /validate/ answers for an image URL: how it would be
+// interpreted under the current flags, or why it would be refused.
+type validation struct {
+	Path       string               `json:"path,omitempty"` // Of the source image.
+	Operations []validatedOperation `json:"operations,omitempty"`
+	Format     string               `json:"format,omitempty"`  // "" = usual.
+	Formats    []string             `json:"formats,omitempty"` // Of a multipart response.
+	Preview    bool                 `json:"preview,omitempty"`
+	Quality    uint                 `json:"quality,omitempty"`
+	Blur       float64              `json:"blur,omitempty"`
+	Pixel      bool                 `json:"pixel,omitempty"`
+	Border     uint                 `json:"border,omitempty"`
+	Error      string               `json:"error,omitempty"`
+}
+
+type validatedOperation struct {
+	Type    string  `json:"type"`
+	Width   uint    `json:"width,omitempty"`
+	Height  uint    `json:"height,omitempty"`
+	Degrees float64 `json:"degrees,omitempty"`
+	Gravity string  `json:"gravity,omitempty"`
+	Pad     string  `json:"pad,omitempty"`
+}
+
+// Names of operation types, as in operationNames.
+var operationTypeNames = map[imager.OperationType]string{
+	imager.OpScale:       "scale",
+	imager.OpCrop:        "crop",
+	imager.OpRotate:      "rotate",
+	imager.OpAspect:      "aspect ratio",
+	imager.OpDownscale:   "downscale",
+	imager.OpFill:        "fill",
+	imager.OpTrim:        "trim",
+	imager.OpCropPercent: "percent crop",
+}
+
+// validateHandler answers a URL like "/validate/image.jpg=s200x200" with
+// JSON describing how "/image.jpg=s200x200" would be processed, without
+// fetching the image, so tools can check the URLs they generate.  Refused
+// URLs are answered with a 400 and the reason.
+func validateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		sendError(w, nil, http.StatusMethodNotAllowed)
+		return
+	}
+
+	var v validation
+	status := http.StatusOK
+
+	path, params, err := parseImageURL(strings.TrimPrefix(r.URL.Path, validatePrefix), r.URL.Query())
+	if err != nil {
+		v.Error = err.Error()
+		status = http.StatusBadRequest
+	} else {
+		v = describeParams(path, params)
+	}
+
+	body, err := json.Marshal(v)
+	if err != nil {
+		sendError(w, err, 0)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// describeParams describes the parsed image URL path and params.
+func describeParams(path string, params imageParams) validation {
+	v := validation{
+		Path:    path,
+		Format:  params.format,
+		Formats: params.formats,
+		Preview: params.preview,
+		Quality: params.quality,
+		Blur:    params.blur,
+		Pixel:   params.pixel,
+		Border:  params.border,
+	}
+
+	for _, op := range params.operations {
+		vo := validatedOperation{
+			Type:    operationTypeNames[op.Type],
+			Width:   op.Width,
+			Height:  op.Height,
+			Degrees: op.Degrees,
+		}
+		for name, pad := range padModes {
+			if pad == op.Pad && op.Pad != imager.PadNone {
+				vo.Pad = name
+			}
+		}
+		if op.Type == imager.OpFill || op.Type == imager.OpCropPercent {
+			for name, gravity := range gravities {
+				if gravity == op.Gravity {
+					vo.Gravity = name
+				}
+			}
+		}
+		v.Operations = append(v.Operations, vo)
+	}
+
+	return v
+}